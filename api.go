@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 )
 
 // вы можете использовать ApiError в коде, который получается в результате генерации
@@ -12,6 +16,9 @@ import (
 type ApiError struct {
 	HTTPStatus int
 	Err        error
+	// необязательный машиночитаемый код ошибки и подробности для клиентов
+	Code    string
+	Details map[string]interface{}
 }
 
 func (ae ApiError) Error() string {
@@ -54,7 +61,7 @@ func NewMyApi() *MyApi {
 }
 
 type ProfileParams struct {
-	Login string `apivalidator:"required"`
+	Login string `apivalidator:"trim,lower,required"`
 }
 
 type CreateParams struct {
@@ -86,13 +93,13 @@ func (srv *MyApi) Profile(ctx context.Context, in ProfileParams) (*User, error)
 	user, exist := srv.users[in.Login]
 	srv.mu.RUnlock()
 	if !exist {
-		return nil, ApiError{http.StatusNotFound, fmt.Errorf("user not exist")}
+		return nil, ApiError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("user not exist")}
 	}
 
 	return user, nil
 }
 
-// apigen:api {"url": "/user/create", "auth": true, "method": "POST"}
+// apigen:api {"url": "/user/create", "auth": true, "method": "POST", "idempotent": true}
 func (srv *MyApi) Create(ctx context.Context, in CreateParams) (*NewUser, error) {
 	if in.Login == "bad_username" {
 		return nil, fmt.Errorf("bad user")
@@ -103,7 +110,7 @@ func (srv *MyApi) Create(ctx context.Context, in CreateParams) (*NewUser, error)
 
 	_, exist := srv.users[in.Login]
 	if exist {
-		return nil, ApiError{http.StatusConflict, fmt.Errorf("user %s exist", in.Login)}
+		return nil, ApiError{HTTPStatus: http.StatusConflict, Err: fmt.Errorf("user %s exist", in.Login)}
 	}
 
 	id := srv.nextID
@@ -153,3 +160,551 @@ func (srv *OtherApi) Create(ctx context.Context, in OtherCreateParams) (*OtherUs
 		Level:    in.Level,
 	}, nil
 }
+
+// 3-я часть
+// структуры для проверки дополнительных возможностей кодогенератора
+
+// apigen:api {"errors": "all"}
+type CheckApi struct {
+}
+
+func NewCheckApi() *CheckApi {
+	return &CheckApi{}
+}
+
+type CheckAllParams struct {
+	Login string `apivalidator:"required,min=3,pattern=^[a-z]+$"`
+	Age   int    `apivalidator:"required,min=18"`
+}
+
+type CheckResult struct {
+	Login string `json:"login"`
+}
+
+// apigen:api {"url": "/check/all"}
+func (srv *CheckApi) All(ctx context.Context, in CheckAllParams) (*CheckResult, error) {
+	return &CheckResult{Login: in.Login}, nil
+}
+
+// errNoRecord - ошибка хранилища, которую FailApi превращает в ApiError через ErrorMapper
+var errNoRecord = errors.New("no record")
+
+type FailApi struct {
+}
+
+func NewFailApi() *FailApi {
+	return &FailApi{}
+}
+
+func (srv *FailApi) MapError(err error) error {
+	if errors.Is(err, errNoRecord) {
+		return ApiError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("record not found"), Code: "not_found"}
+	}
+	return nil
+}
+
+type FailParams struct {
+	Kind string `apivalidator:"required"`
+}
+
+// apigen:api {"url": "/fail"}
+func (srv *FailApi) Fail(ctx context.Context, in FailParams) (*CheckResult, error) {
+	switch in.Kind {
+	case "wrapped":
+		return nil, fmt.Errorf("load user: %w", ApiError{HTTPStatus: http.StatusGone, Err: fmt.Errorf("user deleted"), Code: "gone"})
+	case "pointer":
+		return nil, &ApiError{HTTPStatus: http.StatusForbidden, Err: fmt.Errorf("user hidden")}
+	case "mapped":
+		return nil, fmt.Errorf("load user: %w", errNoRecord)
+	case "deadline":
+		// дедлайн запроса к базе - не таймаут обработчика
+		return nil, fmt.Errorf("load user: %w", context.DeadlineExceeded)
+	}
+	return nil, fmt.Errorf("database is down")
+}
+
+type CheckPatternParams struct {
+	Code string `apivalidator:"required,pattern=^[A-Z]{1,3}-[0-9]+$,max=8"`
+}
+
+// apigen:api {"url": "/check/pattern", "errors": "first"}
+func (srv *CheckApi) Pattern(ctx context.Context, in CheckPatternParams) (*CheckResult, error) {
+	return &CheckResult{Login: in.Code}, nil
+}
+
+type CheckFormatParams struct {
+	Email string `apivalidator:"format=email"`
+	Site  string `apivalidator:"format=url"`
+	ID    string `apivalidator:"format=uuid"`
+	IPv4  string `apivalidator:"format=ipv4"`
+	IPv6  string `apivalidator:"format=ipv6"`
+	Host  string `apivalidator:"format=hostname"`
+	Day   string `apivalidator:"format=date"`
+}
+
+// apigen:api {"url": "/check/format"}
+func (srv *CheckApi) Format(ctx context.Context, in CheckFormatParams) (*CheckResult, error) {
+	return &CheckResult{Login: in.Email}, nil
+}
+
+// apivalidator: requiredif=Email:Notify
+type CheckNotifyParams struct {
+	Email  string `apivalidator:"format=email"`
+	Notify bool   `apivalidator:""`
+}
+
+// apigen:api {"url": "/check/notify", "errors": "first"}
+func (srv *CheckApi) Notify(ctx context.Context, in CheckNotifyParams) (*CheckResult, error) {
+	return &CheckResult{Login: in.Email}, nil
+}
+
+// имена полей совпадают с переменными обработчика и ключевыми словами
+type CheckMatchParams struct {
+	Result string `apivalidator:"enum=win|loss"`
+	Page   int    `apivalidator:"min=1"`
+	Type   string `apivalidator:"default=cup"`
+}
+
+// apigen:api {"url": "/check/match", "paginate": "offset"}
+func (srv *CheckApi) Match(ctx context.Context, in CheckMatchParams, page Page) ([]CheckResult, error) {
+	return []CheckResult{{Login: fmt.Sprintf("%s-%d-%s-%d", in.Result, in.Page, in.Type, page.Limit)}}, nil
+}
+
+// параметры без тегов - метод всё равно вызывается
+type CheckPingParams struct {
+	Verbose bool
+}
+
+// apigen:api {"url": "/check/ping"}
+func (srv *CheckApi) Ping(ctx context.Context, in CheckPingParams) (*CheckResult, error) {
+	return &CheckResult{Login: "pong"}, nil
+}
+
+// apivalidator: gtfield=To>From, gtefield=Max>=Min, eqfield=Confirm=Password
+type CheckRulesParams struct {
+	From     int    `apivalidator:"required"`
+	To       int    `apivalidator:""`
+	Min      int    `apivalidator:""`
+	Max      int    `apivalidator:""`
+	Password string `apivalidator:""`
+	Confirm  string `apivalidator:""`
+}
+
+// apigen:api {"url": "/check/rules"}
+func (srv *CheckApi) Rules(ctx context.Context, in CheckRulesParams) (*CheckResult, error) {
+	return &CheckResult{Login: fmt.Sprintf("%d-%d", in.From, in.To)}, nil
+}
+
+type CheckIntervalParams struct {
+	From int `apivalidator:"min=0"`
+	To   int `apivalidator:"required"`
+}
+
+func (in CheckIntervalParams) Validate(ctx context.Context) error {
+	if in.From > in.To {
+		return fmt.Errorf("from must not exceed to")
+	}
+	if in.To-in.From > 100 {
+		return ApiError{HTTPStatus: http.StatusUnprocessableEntity, Err: fmt.Errorf("range is too wide"), Code: "too_wide"}
+	}
+	return nil
+}
+
+// apigen:api {"url": "/check/interval"}
+func (srv *CheckApi) Interval(ctx context.Context, in CheckIntervalParams) (*CheckResult, error) {
+	return &CheckResult{Login: fmt.Sprintf("%d-%d", in.From, in.To)}, nil
+}
+
+type CheckLoginParams struct {
+	Login string `apivalidator:"required,check=checkNotReserved"`
+}
+
+// apigen:api {"url": "/check/login", "errors": "first"}
+func (srv *CheckApi) Login(ctx context.Context, in CheckLoginParams) (*CheckResult, error) {
+	return &CheckResult{Login: in.Login}, nil
+}
+
+type Level int
+
+// LevelDefault - синоним LevelLow, значения констант повторяются
+const (
+	LevelLow     Level = 1
+	LevelDefault Level = 1
+	LevelHigh    Level = 3
+)
+
+type CheckLevelParams struct {
+	Level int `apivalidator:"enumtype=Level,default=1"`
+}
+
+// apigen:api {"url": "/check/level", "errors": "first"}
+func (srv *CheckApi) Level(ctx context.Context, in CheckLevelParams) (*CheckResult, error) {
+	return &CheckResult{Login: fmt.Sprint(in.Level)}, nil
+}
+
+// ShapeApi отдаёт одни и те же данные в разных форматах ответов
+type ShapeApi struct {
+	sides map[string]int
+	// calls считает вызовы Stat, по нему видно, что ответ взят из кэша
+	calls int
+	mu    *sync.RWMutex
+}
+
+func NewShapeApi() *ShapeApi {
+	return &ShapeApi{
+		sides: map[string]int{
+			"triangle": 3,
+			"square":   4,
+		},
+		mu: &sync.RWMutex{},
+	}
+}
+
+var errShapeNotFound = ApiError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("shape not found"), Code: "not_found"}
+
+type ShapeParams struct {
+	Name string `apivalidator:"required"`
+}
+
+type Shape struct {
+	Name  string `json:"name"`
+	Sides int    `json:"sides"`
+}
+
+// ETag - версия фигуры, по ней GET отвечает 304 на If-None-Match
+func (s Shape) ETag() string {
+	return fmt.Sprintf("%s-%d", s.Name, s.Sides)
+}
+
+// CurrentETag - версия фигуры, которую меняет запрос, по ней проверяется If-Match
+func (srv *ShapeApi) CurrentETag(r *http.Request, params interface{}) (string, error) {
+	in, ok := params.(ShapeParams)
+	if !ok {
+		return "", nil
+	}
+	shape, err := srv.find(in.Name)
+	if err != nil {
+		return "", nil
+	}
+	return shape.ETag(), nil
+}
+
+func (srv *ShapeApi) find(name string) (*Shape, error) {
+	srv.mu.RLock()
+	sides, ok := srv.sides[name]
+	srv.mu.RUnlock()
+	if !ok {
+		return nil, errShapeNotFound
+	}
+	return &Shape{Name: name, Sides: sides}, nil
+}
+
+// apigen:api {"url": "/shape/bare", "envelope": "bare"}
+func (srv *ShapeApi) Bare(ctx context.Context, in ShapeParams) (*Shape, error) {
+	return srv.find(in.Name)
+}
+
+// ShapeEnvelope - собственный конверт ответов ShapeApi
+type ShapeEnvelope struct {
+	OK     bool        `json:"ok"`
+	Data   interface{} `json:"data,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	Fields []string    `json:"fields,omitempty"`
+}
+
+func (e *ShapeEnvelope) WrapResponse(response interface{}) interface{} {
+	e.OK = true
+	e.Data = response
+	return e
+}
+
+func (e *ShapeEnvelope) WrapError(ae ApiError, fields []FieldError) interface{} {
+	e.Error = ae.Error()
+	for _, fe := range fields {
+		e.Fields = append(e.Fields, fe.Param)
+	}
+	return e
+}
+
+// apigen:api {"url": "/shape/custom", "envelope": "custom", "wrapper": "ShapeEnvelope"}
+func (srv *ShapeApi) Custom(ctx context.Context, in ShapeParams) (*Shape, error) {
+	return srv.find(in.Name)
+}
+
+type ShapeSizeParams struct {
+	Name  string `apivalidator:"required"`
+	Sides int    `apivalidator:"min=3,max=12"`
+}
+
+// apigen:api {"url": "/shape/problem", "error_format": "problem", "errors": "all"}
+func (srv *ShapeApi) Problem(ctx context.Context, in ShapeSizeParams) (*Shape, error) {
+	return &Shape{Name: in.Name, Sides: in.Sides}, nil
+}
+
+type ShapeListParams struct {
+	MinSides int `apivalidator:"min=0"`
+}
+
+// apigen:api {"url": "/shape/value"}
+func (srv *ShapeApi) Value(ctx context.Context, in ShapeParams) (Shape, error) {
+	shape, err := srv.find(in.Name)
+	if err != nil {
+		return Shape{}, err
+	}
+	return *shape, nil
+}
+
+// apigen:api {"url": "/shape/list"}
+func (srv *ShapeApi) List(ctx context.Context, in ShapeListParams) ([]Shape, error) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	shapes := make([]Shape, 0, len(srv.sides))
+	for name, sides := range srv.sides {
+		if sides >= in.MinSides {
+			shapes = append(shapes, Shape{Name: name, Sides: sides})
+		}
+	}
+	sort.Slice(shapes, func(i, j int) bool { return shapes[i].Sides < shapes[j].Sides })
+	return shapes, nil
+}
+
+// apigen:api {"url": "/shape/remove", "method": "POST"}
+func (srv *ShapeApi) Remove(ctx context.Context, in ShapeParams) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if _, ok := srv.sides[in.Name]; !ok {
+		return errShapeNotFound
+	}
+	delete(srv.sides, in.Name)
+	return nil
+}
+
+// FeedApi отдаёт результаты потоком
+type FeedApi struct {
+	// stopped закрывается, когда Endless заметил отключение клиента
+	stopped chan struct{}
+}
+
+func NewFeedApi() *FeedApi {
+	return &FeedApi{stopped: make(chan struct{})}
+}
+
+type FeedParams struct {
+	Count int `apivalidator:"min=0,max=100"`
+}
+
+func feedShape(i int) Shape {
+	return Shape{Name: fmt.Sprintf("shape%d", i), Sides: i}
+}
+
+// apigen:api {"url": "/feed/channel", "stream": "ndjson"}
+func (srv *FeedApi) Channel(ctx context.Context, in FeedParams) (<-chan Shape, error) {
+	shapes := make(chan Shape)
+	go func() {
+		defer close(shapes)
+		for i := 1; i <= in.Count; i++ {
+			select {
+			case shapes <- feedShape(i):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return shapes, nil
+}
+
+// apigen:api {"url": "/feed/iterator", "stream": "ndjson"}
+func (srv *FeedApi) Iterator(ctx context.Context, in FeedParams) (func(yield func(Shape) bool), error) {
+	return func(yield func(Shape) bool) {
+		for i := 1; i <= in.Count; i++ {
+			if !yield(feedShape(i)) {
+				return
+			}
+		}
+	}, nil
+}
+
+// apigen:api {"url": "/feed/broken", "stream": "ndjson"}
+func (srv *FeedApi) Broken(ctx context.Context, in FeedParams) (func(yield func(Shape, error) bool), error) {
+	return func(yield func(Shape, error) bool) {
+		for i := 1; i <= in.Count; i++ {
+			if !yield(feedShape(i), nil) {
+				return
+			}
+		}
+		yield(Shape{}, fmt.Errorf("feed is broken"))
+	}, nil
+}
+
+// apigen:api {"url": "/feed/endless", "stream": "ndjson"}
+func (srv *FeedApi) Endless(ctx context.Context, in FeedParams) (<-chan Shape, error) {
+	shapes := make(chan Shape)
+	go func() {
+		defer close(srv.stopped)
+		for i := 1; ; i++ {
+			select {
+			case shapes <- feedShape(i):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return shapes, nil
+}
+
+type FeedEventsParams struct {
+	LastEventID int  `apivalidator:"paramname=last_event_id,min=0"`
+	Count       int  `apivalidator:"min=0,max=100"`
+	Fail        bool `apivalidator:""`
+}
+
+// apigen:api {"url": "/feed/events", "stream": "sse"}
+func (srv *FeedApi) Events(ctx context.Context, in FeedEventsParams, send func(ServerEvent) error) error {
+	// события продолжаются после последнего полученного клиентом
+	for i := in.LastEventID + 1; i <= in.LastEventID+in.Count; i++ {
+		if err := send(ServerEvent{ID: strconv.Itoa(i), Event: "shape", Data: feedShape(i)}); err != nil {
+			return err
+		}
+	}
+	if in.Fail {
+		return fmt.Errorf("feed is broken")
+	}
+	return nil
+}
+
+// shapeCount - сколько фигур отдают постраничные методы ShapeApi
+const shapeCount = 8
+
+// apigen:api {"url": "/shape/pages", "paginate": "offset"}
+func (srv *ShapeApi) Pages(ctx context.Context, in ShapeListParams, page Page) ([]Shape, error) {
+	shapes := []Shape{}
+	for i := page.Offset + 1; i <= shapeCount && len(shapes) < page.Limit; i++ {
+		shapes = append(shapes, feedShape(i))
+	}
+	return shapes, nil
+}
+
+type ShapePage struct {
+	Items []Shape `json:"items"`
+	next  int
+}
+
+func (p *ShapePage) NextCursor() string {
+	if p.next == 0 {
+		return ""
+	}
+	return strconv.Itoa(p.next)
+}
+
+// apigen:api {"url": "/shape/cursor", "paginate": "cursor"}
+func (srv *ShapeApi) Cursor(ctx context.Context, in ShapeListParams, page Page) (*ShapePage, error) {
+	from := 1
+	if page.Cursor != "" {
+		var err error
+		if from, err = strconv.Atoi(page.Cursor); err != nil || from < 1 {
+			return nil, ApiError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("bad cursor"), Code: "bad_cursor"}
+		}
+	}
+	result := &ShapePage{Items: []Shape{}}
+	for i := from; i <= shapeCount && len(result.Items) < page.Limit; i++ {
+		result.Items = append(result.Items, feedShape(i))
+	}
+	if last := from + len(result.Items); last <= shapeCount {
+		result.next = last
+	}
+	return result, nil
+}
+
+type ShapeCountParams struct {
+	Count int `apivalidator:"required,min=1,max=500"`
+}
+
+// apigen:api {"url": "/shape/many", "compress": true}
+func (srv *ShapeApi) Many(ctx context.Context, in ShapeCountParams) ([]Shape, error) {
+	shapes := make([]Shape, 0, in.Count)
+	for i := 1; i <= in.Count; i++ {
+		shapes = append(shapes, feedShape(i))
+	}
+	return shapes, nil
+}
+
+type ShapeStat struct {
+	Shape
+	Calls int `json:"calls"`
+}
+
+type ShapeEchoParams struct {
+	Name  string `apivalidator:"required"`
+	Sides int    `apivalidator:""`
+}
+
+// apigen:api {"url": "/shape/echo", "envelope": "bare"}
+func (srv *ShapeApi) Echo(ctx context.Context, in ShapeEchoParams) (*Shape, error) {
+	return &Shape{Name: in.Name, Sides: in.Sides}, nil
+}
+
+// apigen:api {"url": "/shape/stats", "envelope": "bare"}
+func (srv *ShapeApi) Stats(ctx context.Context, in ShapeListParams) ([]ShapeStat, error) {
+	shapes, err := srv.List(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	stats := make([]ShapeStat, 0, len(shapes))
+	for _, shape := range shapes {
+		stats = append(stats, ShapeStat{Shape: shape, Calls: srv.calls})
+	}
+	return stats, nil
+}
+
+// apigen:api {"url": "/shape/stat", "cache": {"ttl": "1s", "vary": ["name"]}}
+func (srv *ShapeApi) Stat(ctx context.Context, in ShapeParams) (*ShapeStat, error) {
+	shape, err := srv.find(in.Name)
+	if err != nil {
+		return nil, err
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.calls++
+	return &ShapeStat{Shape: *shape, Calls: srv.calls}, nil
+}
+
+type ShapeAddParams struct {
+	Name  string `apivalidator:"required"`
+	Sides int    `apivalidator:"required,min=1"`
+}
+
+// apigen:api {"url": "/shape/add", "method": "POST", "idempotent": true, "compress": true}
+func (srv *ShapeApi) Add(ctx context.Context, in ShapeAddParams) (*Shape, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if _, ok := srv.sides[in.Name]; ok {
+		return nil, ApiError{HTTPStatus: http.StatusConflict, Err: fmt.Errorf("shape exists"), Code: "exists"}
+	}
+	srv.sides[in.Name] = in.Sides
+	return &Shape{Name: in.Name, Sides: in.Sides}, nil
+}
+
+type ShapeDrawParams struct {
+	Name string `apivalidator:"required"`
+	// Wait - рисовать, пока не истечёт время запроса
+	Wait bool `apivalidator:""`
+	// Query - ждать запрос с собственным, более коротким дедлайном
+	Query bool `apivalidator:""`
+}
+
+// apigen:api {"url": "/shape/draw", "method": "POST", "max_body": "64", "timeout": "50ms"}
+func (srv *ShapeApi) Draw(ctx context.Context, in ShapeDrawParams) (*Shape, error) {
+	if in.Wait {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if in.Query {
+		queryCtx, cancel := context.WithTimeout(ctx, time.Millisecond)
+		defer cancel()
+		<-queryCtx.Done()
+		return nil, fmt.Errorf("query: %w", queryCtx.Err())
+	}
+	return srv.find(in.Name)
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// функции для валидатора check могут лежать в любом файле пакета
+
+var reservedLogins = []string{"admin", "root", "support"}
+
+func checkNotReserved(login string) error {
+	for _, reserved := range reservedLogins {
+		if strings.EqualFold(login, reserved) {
+			return fmt.Errorf("login %s is reserved", login)
+		}
+	}
+	return nil
+}
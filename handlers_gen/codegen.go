@@ -12,14 +12,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"go/ast"
+	"go/build"
+	"go/constant"
 	"go/format"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
 type FieldType int
@@ -28,6 +36,7 @@ const (
 	FieldTypeUnknown FieldType = iota
 	FieldTypeInt
 	FieldTypeString
+	FieldTypeBool
 )
 
 type ValidatorAction string
@@ -40,20 +49,85 @@ const (
 	ValidatorDefault   ValidatorAction = "default"
 	ValidatorMin       ValidatorAction = "min"
 	ValidatorMax       ValidatorAction = "max"
+	ValidatorPattern   ValidatorAction = "pattern"
+	ValidatorFormat    ValidatorAction = "format"
+	ValidatorLen       ValidatorAction = "len"
+	ValidatorBytes     ValidatorAction = "bytes"
+	ValidatorCheck     ValidatorAction = "check"
+	ValidatorEnumType  ValidatorAction = "enumtype"
 )
 
+//transforms normalising a string before it's checked
+const (
+	ValidatorTrim     ValidatorAction = "trim"
+	ValidatorLower    ValidatorAction = "lower"
+	ValidatorUpper    ValidatorAction = "upper"
+	ValidatorCollapse ValidatorAction = "collapse"
+)
+
+//transformExprs are expressions of the transforms, %s is replaced by a variable of a field
+var transformExprs = map[ValidatorAction]string{
+	ValidatorTrim:     "strings.TrimSpace(%s)",
+	ValidatorLower:    "strings.ToLower(%s)",
+	ValidatorUpper:    "strings.ToUpper(%s)",
+	ValidatorCollapse: `strings.Join(strings.Fields(%s), " ")`,
+}
+
+//cross-field rules of a structure, e.g. "gtfield=To>From"
+const (
+	ValidatorGtField    ValidatorAction = "gtfield"
+	ValidatorGteField   ValidatorAction = "gtefield"
+	ValidatorEqField    ValidatorAction = "eqfield"
+	ValidatorRequiredIf ValidatorAction = "requiredif"
+)
+
+//structRuleSeparators are separators of two fields in values of cross-field rules
+var structRuleSeparators = map[ValidatorAction]string{
+	ValidatorGtField:    ">",
+	ValidatorGteField:   ">=",
+	ValidatorEqField:    "=",
+	ValidatorRequiredIf: ":",
+}
+
+//validatorActions are known keys of 'apivalidator' tags
+var validatorActions = map[string]ValidatorAction{
+	ValidatorRequired.String():  ValidatorRequired,
+	ValidatorParamName.String(): ValidatorParamName,
+	ValidatorEnum.String():      ValidatorEnum,
+	ValidatorDefault.String():   ValidatorDefault,
+	ValidatorMin.String():       ValidatorMin,
+	ValidatorMax.String():       ValidatorMax,
+	ValidatorPattern.String():   ValidatorPattern,
+	ValidatorFormat.String():    ValidatorFormat,
+	ValidatorLen.String():       ValidatorLen,
+	ValidatorBytes.String():     ValidatorBytes,
+	ValidatorCheck.String():     ValidatorCheck,
+	ValidatorEnumType.String():  ValidatorEnumType,
+	ValidatorTrim.String():      ValidatorTrim,
+	ValidatorLower.String():     ValidatorLower,
+	ValidatorUpper.String():     ValidatorUpper,
+	ValidatorCollapse.String():  ValidatorCollapse,
+}
+
 //an implementation of 'Stringer' interface
 func (v ValidatorAction) String() string {
 	return string(v)
 }
 
+//Transforms go first, then default values are set, then values are checked
 const (
-	PosRequired = iota
-	PosParamName
+	PosParamName = iota
+	PosBytes
+	PosTransform
+	PosDefault
+	PosRequired
 	PosMin
 	PosMax
-	PosDefault
+	PosLen
 	PosEnum
+	PosPattern
+	PosFormat
+	PosCheck
 )
 
 //Order gets an order for sorting
@@ -61,8 +135,20 @@ func (v ValidatorAction) Order() int {
 	switch v {
 	case ValidatorDefault:
 		return PosDefault
-	case ValidatorEnum:
+	case ValidatorEnum, ValidatorEnumType:
 		return PosEnum
+	case ValidatorPattern:
+		return PosPattern
+	case ValidatorFormat:
+		return PosFormat
+	case ValidatorLen:
+		return PosLen
+	case ValidatorBytes:
+		return PosBytes
+	case ValidatorCheck:
+		return PosCheck
+	case ValidatorTrim, ValidatorLower, ValidatorUpper, ValidatorCollapse:
+		return PosTransform
 	case ValidatorParamName:
 		return PosParamName
 	case ValidatorMax:
@@ -81,26 +167,389 @@ type ConditionString struct {
 	Value string
 }
 
+//IDs of validation messages, translations are looked up by them
+const (
+	MsgRequired   = "required"
+	MsgTypeInt    = "type_int"
+	MsgTypeBool   = "type_bool"
+	MsgMin        = "min"
+	MsgMinLen     = "min_len"
+	MsgMax        = "max"
+	MsgMaxLen     = "max_len"
+	MsgEnum       = "enum"
+	MsgPattern    = "pattern"
+	MsgFormat     = "format"
+	MsgLen        = "len"
+	MsgGtField    = "gtfield"
+	MsgGteField   = "gtefield"
+	MsgEqField    = "eqfield"
+	MsgRequiredIf = "requiredif"
+)
+
+//messageTemplates are default (english) templates of validation messages,
+//placeholders like {param} are replaced by arguments of a message
+var messageTemplates = map[string]string{
+	MsgRequired:   "{param} must me not empty",
+	MsgTypeInt:    "{param} must be int",
+	MsgTypeBool:   "{param} must be bool",
+	MsgMin:        "{param} must be >= {min}",
+	MsgMinLen:     "{param} len must be >= {min}",
+	MsgMax:        "{param} must be <= {max}",
+	MsgMaxLen:     "{param} len must be <= {max}",
+	MsgEnum:       "{param} must be one of [{values}]",
+	MsgPattern:    "{param} must match {pattern}",
+	MsgFormat:     "{param} must be a valid {format}",
+	MsgLen:        "{param} len must be {len}",
+	MsgGtField:    "{param} must be greater than {field}",
+	MsgGteField:   "{param} must be greater than or equal to {field}",
+	MsgEqField:    "{param} must be equal to {field}",
+	MsgRequiredIf: "{param} is required if {field} is set",
+}
+
+type MessageArgs map[string]string
+
 type FieldDesc struct {
 	Name             string
 	Type             FieldType
 	ConditionsString []ConditionString
 }
 
+//has reports whether a field has a condition
+func (f FieldDesc) has(key ValidatorAction) bool {
+	for _, cond := range f.ConditionsString {
+		if cond.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+//lengthExpr returns an expression of a length of a string field in runes,
+//or in bytes if the field has 'bytes' condition
+func (f FieldDesc) lengthExpr(varName string) string {
+	if f.has(ValidatorBytes) {
+		return "len(" + varName + ")"
+	}
+	return "utf8.RuneCountInString(" + varName + ")"
+}
+
+//paramName returns a name of a request parameter of a field
+func (f FieldDesc) paramName() string {
+	for _, cond := range f.ConditionsString {
+		if cond.Key == ValidatorParamName {
+			return cond.Value
+		}
+	}
+	return strings.ToLower(f.Name)
+}
+
+//localName returns a name of a local variable of a field in generated handlers,
+//the prefix keeps it apart from other locals of handlers, keywords and packages
+func (f FieldDesc) localName() string {
+	return "param" + strings.Title(f.Name)
+}
+
+//goType returns a name of the type of a field
+func (f FieldDesc) goType() string {
+	switch f.Type {
+	case FieldTypeInt:
+		return "int"
+	case FieldTypeBool:
+		return "bool"
+	}
+	return "string"
+}
+
+//zeroValue returns a literal of the zero value of a field
+func (f FieldDesc) zeroValue() string {
+	switch f.Type {
+	case FieldTypeInt:
+		return "0"
+	case FieldTypeBool:
+		return "false"
+	}
+	return `""`
+}
+
+//countsRunes reports whether the generated checks of a field count runes
+func (f FieldDesc) countsRunes() bool {
+	return f.Type == FieldTypeString && !f.has(ValidatorBytes) &&
+		(f.has(ValidatorMin) || f.has(ValidatorMax) || f.has(ValidatorLen))
+}
+
 type StructDesc struct {
 	Name   string
 	fields []FieldDesc
+	rules  []ConditionString
+	//validate is set if the structure has 'Validate(ctx context.Context) error' method
+	validate bool
+}
+
+//field finds a description of a field by its name
+func (s StructDesc) field(name string) (FieldDesc, bool) {
+	for _, f := range s.fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return FieldDesc{}, false
 }
 
 type ApiDesc struct {
-	structs  map[string]StructDesc
-	handlers []Handler
+	structs   map[string]StructDesc
+	handlers  []Handler
+	receivers map[string]HandlerApiGenComment
+	validated map[string]bool
+	//checks are functions which can be used by 'check' validator by types of their argument
+	checks map[string]FieldType
+	//constants are typed constants of the parsed file by names of their types
+	constants map[string][]*types.Const
 }
 
+const (
+	ErrorsFirst = "first"
+	ErrorsAll   = "all"
+)
+
+//ErrorCodeType is a code of an error of a parameter which can't be converted to the type of its field,
+//other failed checks are reported with the name of their ValidatorAction
+const ErrorCodeType = "type"
+
+//envelopes of responses: the legacy {"error": "", "response": ...},
+//a bare result with errors as RFC 7807 problem details
+//or a custom type implementing ResponseWrapper of the generated code and named by 'wrapper' option
+const (
+	EnvelopeLegacy = "legacy"
+	EnvelopeBare   = "bare"
+	EnvelopeCustom = "custom"
+)
+
+//formats of errors of the legacy envelope
+const (
+	ErrorFormatLegacy  = "legacy"
+	ErrorFormatProblem = "problem"
+)
+
+//modes of pagination, a paginated method gets 'Page' parameter after parameters of a request
+const (
+	PaginateOffset = "offset"
+	PaginateCursor = "cursor"
+)
+
+//formats of streamed results
+const (
+	StreamNDJSON = "ndjson"
+	StreamSSE    = "sse"
+)
+
 type HandlerApiGenComment struct {
-	Url    string
-	Auth   bool
-	Method string
+	Url         string
+	Auth        bool
+	Method      string
+	Errors      string
+	Envelope    string
+	Wrapper     string
+	ErrorFormat string `json:"error_format"`
+	Stream      string
+	Paginate    string
+	//Compress enables compression of responses, it's a pointer to let an endpoint turn off compression of its receiver
+	Compress   *bool
+	Cache      *CacheOptions
+	Idempotent bool
+	MaxBody    string `json:"max_body"`
+	Timeout    string
+}
+
+//CacheOptions enable caching of results of an endpoint for 'TTL' by parameters listed in 'Vary',
+//results are cached by all parameters if 'Vary' is empty
+type CacheOptions struct {
+	TTL  string `json:"ttl"`
+	Vary []string
+}
+
+//ttl returns a parsed 'TTL' option
+func (c CacheOptions) ttl() time.Duration {
+	ttl, err := time.ParseDuration(c.TTL)
+	if err != nil || ttl <= 0 {
+		return 0
+	}
+	return ttl
+}
+
+//varyFields returns fields of parameters which a cached result depends on
+func (c CacheOptions) varyFields(name string, params StructDesc) []FieldDesc {
+	if len(c.Vary) == 0 {
+		return params.fields
+	}
+	var fields []FieldDesc
+	for _, param := range c.Vary {
+		found := false
+		for _, field := range params.fields {
+			if field.paramName() == param {
+				fields = append(fields, field)
+				found = true
+			}
+		}
+		if !found {
+			log.Fatalf("%s: cache varies by unknown parameter %q", name, param)
+		}
+	}
+	return fields
+}
+
+//inherit fills options which are not set for an endpoint from options of its receiver
+func (m HandlerApiGenComment) inherit(receiver HandlerApiGenComment) HandlerApiGenComment {
+	if m.Errors == "" {
+		m.Errors = receiver.Errors
+	}
+	if m.Envelope == "" {
+		m.Envelope = receiver.Envelope
+		m.Wrapper = receiver.Wrapper
+	}
+	if m.ErrorFormat == "" {
+		m.ErrorFormat = receiver.ErrorFormat
+	}
+	if m.Compress == nil {
+		m.Compress = receiver.Compress
+	}
+	if m.MaxBody == "" {
+		m.MaxBody = receiver.MaxBody
+	}
+	if m.Timeout == "" {
+		m.Timeout = receiver.Timeout
+	}
+	return m
+}
+
+//verify stops the generation if options have unknown values
+func (m HandlerApiGenComment) verify(name string) {
+	switch m.Errors {
+	case "", ErrorsFirst, ErrorsAll:
+	default:
+		log.Fatalf("%s: unknown errors mode %q", name, m.Errors)
+	}
+	switch m.Envelope {
+	case "", EnvelopeLegacy, EnvelopeBare:
+	case EnvelopeCustom:
+		if m.Wrapper == "" {
+			log.Fatalf("%s: 'custom' envelope needs a type in 'wrapper' option", name)
+		}
+	default:
+		log.Fatalf("%s: unknown envelope %q", name, m.Envelope)
+	}
+	switch m.ErrorFormat {
+	case "", ErrorFormatLegacy, ErrorFormatProblem:
+	default:
+		log.Fatalf("%s: unknown error format %q", name, m.ErrorFormat)
+	}
+	switch m.Stream {
+	case "", StreamNDJSON, StreamSSE:
+	default:
+		log.Fatalf("%s: unknown stream format %q", name, m.Stream)
+	}
+	switch m.Paginate {
+	case "", PaginateOffset, PaginateCursor:
+	default:
+		log.Fatalf("%s: unknown pagination %q", name, m.Paginate)
+	}
+	if m.Cache != nil && m.Cache.ttl() == 0 {
+		log.Fatalf("%s: cache needs a positive duration in 'ttl' option, got %q", name, m.Cache.TTL)
+	}
+	if m.MaxBody != "" && m.maxBody() == 0 {
+		log.Fatalf("%s: 'max_body' option needs a positive size like \"512KB\", got %q", name, m.MaxBody)
+	}
+	if m.Timeout != "" && m.timeout() == 0 {
+		log.Fatalf("%s: 'timeout' option needs a positive duration, got %q", name, m.Timeout)
+	}
+}
+
+//byteUnits are multipliers of units of 'max_body' option
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+//maxBody returns a parsed 'max_body' option like "1MB" or "512", zero if it's not set or invalid
+func (m HandlerApiGenComment) maxBody() int64 {
+	text, multiplier := strings.ToUpper(strings.TrimSpace(m.MaxBody)), int64(1)
+	for _, unit := range byteUnits {
+		if number, ok := strings.CutSuffix(text, unit.suffix); ok {
+			text, multiplier = strings.TrimSpace(number), unit.size
+			break
+		}
+	}
+	size, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || size <= 0 {
+		return 0
+	}
+	return size * multiplier
+}
+
+//timeout returns a parsed 'timeout' option, zero if it's not set or invalid
+func (m HandlerApiGenComment) timeout() time.Duration {
+	timeout, err := time.ParseDuration(m.Timeout)
+	if err != nil || timeout <= 0 {
+		return 0
+	}
+	return timeout
+}
+
+//streamMediaType returns a constant with a media type a client must accept to get streamed results,
+//clients accepting only "application/json" get 406 as a stream of NDJSON isn't a JSON document
+func (m HandlerApiGenComment) streamMediaType() string {
+	if m.Stream == StreamSSE {
+		return "contentTypeEventStream"
+	}
+	return "contentTypeNDJSON"
+}
+
+//newStream returns statements starting a stream of results in the format of the endpoint
+func (m HandlerApiGenComment) newStream() string {
+	if m.Stream == StreamSSE {
+		return "stream := newSSEStream(w, r)\ndefer stream.stop()\n"
+	}
+	return "stream := newNDJSONStream(w, r)\n"
+}
+
+//errorWriter returns an expression of errorWriter of the generated code writing errors in a format of the envelope
+func (m HandlerApiGenComment) errorWriter() string {
+	switch m.Envelope {
+	case EnvelopeBare:
+		return "problemErrors{}"
+	case EnvelopeCustom:
+		return "wrappedErrors{wrapper: new(" + m.Wrapper + ")}"
+	}
+	if m.ErrorFormat == ErrorFormatProblem {
+		return "problemErrors{}"
+	}
+	return "legacyErrors{}"
+}
+
+//serveAnswer returns a statement writing a response expression
+func (m HandlerApiGenComment) serveAnswer(response string) string {
+	var options []string
+	if m.Compress != nil && *m.Compress {
+		options = append(options, "compress: true")
+	}
+	if m.Cache != nil {
+		options = append(options, "cacheControl: "+strconv.Quote(m.cacheControl()))
+	}
+	return "serveAnswer(w, r, " + m.errorWriter() + ", " + response + ", answerOptions{" + strings.Join(options, ", ") + "})"
+}
+
+//cacheControl returns 'Cache-Control' header of cached results of an endpoint,
+//results of endpoints with authorization aren't kept by shared caches
+func (m HandlerApiGenComment) cacheControl() string {
+	cacheControl := "max-age=" + strconv.Itoa(int(m.Cache.ttl().Seconds()))
+	if m.Auth {
+		cacheControl = "private, " + cacheControl
+	}
+	return cacheControl
+}
+
+//writeError returns a statement writing an error expression in a format of the envelope
+func (m HandlerApiGenComment) writeError(apiError string) string {
+	return m.errorWriter() + ".writeError(w, r, " + apiError + ", nil)"
 }
 
 type Handler struct {
@@ -108,18 +557,101 @@ type Handler struct {
 	Meta          HandlerApiGenComment
 	HandlerMethod string
 	ParamIn       string
-	ResultOut     string
+	//Paged is set for methods having 'Page' parameter
+	Paged bool
+	//ResultType is a type of the first result of a method as it's written in the source, e.g. "*User" or "[]User",
+	//it's empty for methods returning an error only, they answer with 204 No Content
+	ResultType string
+	//Stream is a kind of a streamed result, StreamElem is a type of its elements
+	Stream        StreamKind
+	StreamElem    string
 	ParamInStruct []StructDesc
 }
 
+//StreamKind is a kind of a result which is written by elements as newline-delimited JSON
+type StreamKind int
+
+const (
+	StreamNone StreamKind = iota
+	//StreamChan is "<-chan T"
+	StreamChan
+	//StreamIter is "func(yield func(T) bool)"
+	StreamIter
+	//StreamIterErr is "func(yield func(T, error) bool)", an error stops the stream
+	StreamIterErr
+	//StreamSend is "send func(T) error" parameter following parameters of a method
+	//which returns an error only
+	StreamSend
+)
+
+//detectStream recognizes streamed results by their types as they're written in the source
+func detectStream(expr ast.Expr) (StreamKind, string) {
+	switch t := expr.(type) {
+	case *ast.ChanType:
+		if t.Dir&ast.RECV != 0 {
+			return StreamChan, types.ExprString(t.Value)
+		}
+	case *ast.FuncType:
+		params := fieldListTypes(t.Params)
+		if len(params) != 1 || len(fieldListTypes(t.Results)) != 0 {
+			return StreamNone, ""
+		}
+		yield, ok := params[0].(*ast.FuncType)
+		if !ok {
+			return StreamNone, ""
+		}
+		results := fieldListTypes(yield.Results)
+		if len(results) != 1 || types.ExprString(results[0]) != "bool" {
+			return StreamNone, ""
+		}
+		switch elems := fieldListTypes(yield.Params); {
+		case len(elems) == 1:
+			return StreamIter, types.ExprString(elems[0])
+		case len(elems) == 2 && types.ExprString(elems[1]) == "error":
+			return StreamIterErr, types.ExprString(elems[0])
+		}
+	}
+	return StreamNone, ""
+}
+
+//detectSendFunc recognizes "func(T) error" parameters and returns T
+func detectSendFunc(expr ast.Expr) (string, bool) {
+	send, ok := expr.(*ast.FuncType)
+	if !ok {
+		return "", false
+	}
+	params, results := fieldListTypes(send.Params), fieldListTypes(send.Results)
+	if len(params) != 1 || len(results) != 1 || types.ExprString(results[0]) != "error" {
+		return "", false
+	}
+	return types.ExprString(params[0]), true
+}
+
+//fieldListTypes returns a type per every parameter or result, e.g. two for "a, b int"
+func fieldListTypes(list *ast.FieldList) []ast.Expr {
+	var res []ast.Expr
+	if list == nil {
+		return res
+	}
+	for _, field := range list.List {
+		for i := 0; i < len(field.Names) || i == 0; i++ {
+			res = append(res, field.Type)
+		}
+	}
+	return res
+}
+
 var funcMap = template.FuncMap{
 	"CapitalizeFirst": strings.Title,
 }
 
 var structRespTpl = template.Must(template.New("structTpl").Funcs(funcMap).Parse(`
 type Resp{{ .StructName }}{{ .HandlerMethod | CapitalizeFirst }}  struct {
-	{{ .ResultOut }}` + " `json:\"response\"`\n" +
-	" EmptyError string `json:\"error\"` \n}\n\n"))
+	Response {{ .ResultType }}` + " `json:\"response\"`\n" +
+	" EmptyError string `json:\"error\"` \n" +
+	"{{ if eq .Meta.Paginate \"cursor\" }} NextCursor string `json:\"next_cursor,omitempty\"` \n{{ end }}}\n\n" +
+	"func (resp Resp{{ .StructName }}{{ .HandlerMethod | CapitalizeFirst }}) payload() interface{} {\n" +
+	"	return resp.Response\n}\n\n"))
 
 func main() {
 
@@ -135,14 +667,13 @@ func main() {
 		fmt.Println("Done")
 	}()
 
-	generateImportSection(&buffer, node.Name.Name)
-	generateApiErrorsFuncSection(&buffer)
-	generateApiErrorsSection(&buffer)
-	generateAuxiliaryFunctionsSection(&buffer)
-
 	apiDesc := ApiDesc{
-		structs:  make(map[string]StructDesc),
-		handlers: make([]Handler, 0),
+		constants: collectTypedConstants(fset, node),
+		structs:   make(map[string]StructDesc),
+		handlers:  make([]Handler, 0),
+		receivers: make(map[string]HandlerApiGenComment),
+		validated: make(map[string]bool),
+		checks:    make(map[string]FieldType),
 	}
 	for _, f := range node.Decls {
 		switch a := f.(type) {
@@ -154,10 +685,25 @@ func main() {
 			continue
 		}
 	}
-
+	gatherInfoPackageFuncs(fset, &apiDesc)
+	applyReceiverMeta(&apiDesc)
+	addUntaggedParamStructs(&apiDesc)
+	applyValidateMethods(&apiDesc)
+	verifyChecks(apiDesc)
+	resolveEnumTypes(&apiDesc)
+
+	generateImportSection(&buffer, node.Name.Name, collectImports(apiDesc.structs))
+	generateApiErrorsFuncSection(&buffer)
+	generateApiErrorsSection(&buffer)
+	generateAuxiliaryFunctionsSection(&buffer)
+	generateEncodersSection(&buffer)
+	generateStreamsSection(&buffer)
+	generateMessagesSection(&buffer)
+	generatePatternsSection(&buffer, apiDesc.structs)
+	generateFormatsSection(&buffer, apiDesc.structs)
 	generateResponseStructSection(&buffer, apiDesc.handlers)
 	generateHandlers(&buffer, apiDesc.handlers, apiDesc.structs)
-	generateServeFunc(&buffer, apiDesc.handlers)
+	generateServeFunc(&buffer, apiDesc.handlers, apiDesc.receivers)
 	formatCode(&buffer)
 
 	//saving
@@ -165,10 +711,12 @@ func main() {
 
 }
 
+//paramsVar is a name of a local variable of parameters in generated handlers
+const paramsVar = "params"
+
 //generateHandlers generates handlers
 func generateHandlers(b *bytes.Buffer, handlers []Handler, structs map[string]StructDesc) {
 	fmt.Println("Generating handlers")
-	//only stubs for now
 
 	for _, h := range handlers {
 		str := `
@@ -176,209 +724,489 @@ func generateHandlers(b *bytes.Buffer, handlers []Handler, structs map[string]St
 			"\n\n"
 		b.WriteString(str)
 		//Post or not
-		var paramInStruct StructDesc
-		var foundParamInStruct = false
 		if h.Meta.Method == "POST" {
-			str := `			if r.Method != "POST" {
-				errBadMethod.serve(w)
+			str = `			if r.Method != "POST" {
+				` + h.Meta.writeError("errBadMethod") + `
 				return
 			}
 `
 			b.WriteString(str)
-			if h.Meta.Auth {
-				str = `
+		}
+		if h.Meta.Auth {
+			str = `
 				if r.Header.Get("X-Auth") != "100500" {
-				errUnauthorized.serve(w)
+				` + h.Meta.writeError("errUnauthorized") + `
 				return
 				}`
-				b.WriteString(str)
-			}
+			b.WriteString(str)
+		}
+		if h.Meta.MaxBody != "" {
+			b.WriteString("\nr.Body = http.MaxBytesReader(w, r.Body, " + strconv.FormatInt(h.Meta.maxBody(), 10) + ")\n")
+		}
+		if h.Meta.Timeout != "" {
+			str = `
+				r, cancel := requestWithTimeout(r, time.Duration(` + strconv.FormatInt(int64(h.Meta.timeout()), 10) + `))
+				defer cancel()`
+			b.WriteString(str)
+		}
+		if h.Meta.Idempotent {
+			str = `
+				w, finish := serveIdempotent(w, r, ` + h.Meta.errorWriter() + `, srv)
+				if finish == nil {
+					return
+				}
+				defer finish()`
+			b.WriteString(str)
+		}
 
-			b.WriteString("\n_ = r.ParseForm()\n")
+		paramInStruct := structs[h.ParamIn]
 
-			if paramInStruct, foundParamInStruct = structs[h.ParamIn]; foundParamInStruct {
-				for _, field := range paramInStruct.fields {
-					lowFieldName := strings.ToLower(field.Name)
-					if field.Type == FieldTypeInt {
-						str = lowFieldName + ", err := strconv.Atoi(r.Form.Get(\"" + lowFieldName + "\"))\n"
-						str += `if err != nil {
-							NewApiError("` + lowFieldName + ` must be int", http.StatusBadRequest).serve(w)
-							return
-						}`
-					} else {
-						str = lowFieldName + " := r.Form.Get(\"" + lowFieldName + "\")\n"
-					}
-					b.WriteString(str + "\n")
-
-					for _, cond := range field.ConditionsString {
-						if cond.Key == ValidatorRequired {
-							if field.Type == FieldTypeInt {
-								str = `if ` + lowFieldName + ` == nil {
-								errEmptyLogin.serve(w)
-								return
-							}`
-							} else {
-								str = `if ` + lowFieldName + ` == "" {
-								errEmptyLogin.serve(w)
-								return
-							}`
-							}
-							b.WriteString(str + "\n")
-						}
-						if cond.Key == ValidatorMin {
-							if field.Type == FieldTypeInt {
-								str = `if ` + lowFieldName + ` < ` + cond.Value + ` {
-									NewApiError("` + lowFieldName + ` must be >= ` + cond.Value + `", http.StatusBadRequest).serve(w)
-									return
-								}`
-							} else {
-								str = `if len(` + lowFieldName + `) < ` + cond.Value + ` {
-									NewApiError("` + lowFieldName + ` len must be >= ` + cond.Value + `", http.StatusBadRequest).serve(w)
-									return
-								}`
-							}
-							b.WriteString(str + "\n")
-						}
-						if cond.Key == ValidatorMax {
-							if field.Type == FieldTypeInt {
-								str = `if ` + lowFieldName + ` > ` + cond.Value + ` {
-									NewApiError("` + lowFieldName + ` must be <= ` + cond.Value + `", http.StatusBadRequest).serve(w)
-									return
-								}`
-							} else {
-								str = `if len(` + lowFieldName + `) > ` + cond.Value + ` {
-									NewApiError("` + lowFieldName + ` len must be <= ` + cond.Value + `", http.StatusBadRequest).serve(w)
-									return
-								}`
-							}
-							b.WriteString(str + "\n")
-						}
-						if cond.Key == ValidatorParamName {
-							str = cond.Value + ` := r.Form.Get("` + cond.Value + `")
-							if ` + cond.Value + ` != "" {
-								` + lowFieldName + ` = ` + cond.Value + `
-							}`
-							b.WriteString(str + "\n")
-						}
-						if cond.Key == ValidatorDefault {
+		// Create a struct of parameters
+		str = `
+			if !parseForm(w, r, ` + h.Meta.errorWriter() + `) {
+				return
+			}`
+		b.WriteString(str + "\n")
+		if h.Meta.Stream == StreamSSE {
+			b.WriteString("bindLastEventID(r)\n")
+		}
+		generateParamsBinding(b, h, paramInStruct)
 
-							str = `if ` + lowFieldName + ` == "" {
-								` + lowFieldName + ` = "` + cond.Value + `"
-							}`
-							b.WriteString(str + "\n")
-						}
-						if cond.Key == ValidatorEnum {
-							condValues := strings.Split(cond.Value, "|")
-							b.WriteString("m := make(map[string]bool)\n")
-							for _, condV := range condValues {
-								str = `m["` + condV + `"] = true`
-								b.WriteString(str + "\n")
-							}
-							str = `_, prs := m[` + lowFieldName + `]
-							if prs == false {
-								NewApiError("` + lowFieldName + ` must be one of [` + strings.Join(condValues, ", ") + `]", http.StatusBadRequest).serve(w)
-								return
-							}`
-							b.WriteString(str + "\n")
-						}
-					}
+		str = paramsVar + ` := ` + h.ParamIn + "{\n"
+		for _, field := range paramInStruct.fields {
+			str += field.Name + ":" + field.localName() + ",\n"
+		}
+		str += "\n"
+		b.WriteString(str)
 
-				}
+		b.WriteString("\n}\n")
 
-			}
-		} else {
-			paramInStruct, foundParamInStruct = structs[h.ParamIn]
-			for _, field := range paramInStruct.fields {
-				lowFieldName := strings.ToLower(field.Name)
-				str = `	var ` + lowFieldName + ` string
-
-	switch r.Method {
-	case "GET":
-		` + lowFieldName + ` = r.URL.Query().Get("` + lowFieldName + `")
-		if ` + lowFieldName + ` == "" {
-			errEmptyLogin.serve(w)
-			return
+		if paramInStruct.validate {
+			str = `if err := ` + paramsVar + `.Validate(r.Context()); err != nil {
+					serveValidateError(w, r, ` + h.Meta.errorWriter() + `, err)
+					return
+				}`
+			b.WriteString(str + "\n")
 		}
 
-	case "POST":
-		_ = r.ParseForm()
-		` + lowFieldName + ` = r.Form.Get("` + lowFieldName + `")
-		if ` + lowFieldName + ` == "" {
-			errEmptyLogin.serve(w)
-			return
+		//a receiver implementing CurrentETagger, i.e. having a method
+		//CurrentETag(r *http.Request, params interface{}) (string, error) which returns
+		//a version of a resource changed by the parameters, gets 412 for mutating requests
+		//with 'If-Match' header which doesn't match the version
+		str = `if err := checkIfMatch(r, srv, ` + paramsVar + `); err != nil {
+				serveMethodError(w, r, ` + h.Meta.errorWriter() + `, srv, err)
+				return
+			}`
+		b.WriteString(str + "\n")
+
+		if h.Paged {
+			str = `page, err := bindPage(r, ` + strconv.Quote(h.Meta.Paginate) + `)
+				if err != nil {
+					serveValidateError(w, r, ` + h.Meta.errorWriter() + `, err)
+					return
+				}`
+			b.WriteString(str + "\n")
 		}
-	}
-`
-				str += "\n"
-				b.WriteString(str)
-			}
+
+		if h.Stream != StreamNone {
+			str = `if !acceptsMediaType(r, ` + h.Meta.streamMediaType() + `) {
+					` + h.Meta.writeError("errNotAcceptable") + `
+					return
+				}`
+			b.WriteString(str + "\n")
 		}
 
-		// Create a struct of parameters
-		if foundParamInStruct {
-			str = strings.ToLower(h.ParamIn) + ` := ` + h.ParamIn + "{\n"
-			for _, field := range paramInStruct.fields {
-				str += field.Name + ":" + strings.ToLower(field.Name) + ",\n"
-			}
-			str += "\n"
-			b.WriteString(str)
+		if h.Stream == StreamSend {
+			str = h.Meta.newStream() + `err = srv.` + strings.Title(h.HandlerMethod) + `(r.Context(), ` + paramsVar + `, func(item ` + h.StreamElem + `) error {
+					if r.Context().Err() != nil || !stream.write(item) {
+						return ErrStreamClosed
+					}
+					return nil
+				})
+				if err != nil && !errors.Is(err, ErrStreamClosed) {
+					stream.fail(srv, err)
+				}`
+			b.WriteString(str + "\n}\n")
+			continue
+		}
 
-			b.WriteString("\n}\n")
+		call := `srv.` + strings.Title(h.HandlerMethod) + `(r.Context(), ` + paramsVar
+		if h.Paged {
+			call += `, page`
+		}
+		call += `)`
 
-			str = strings.ToLower(h.ResultOut) + `, err := srv.` + strings.Title(h.HandlerMethod) + `(r.Context(), ` + strings.ToLower(h.ParamIn) + ")\n"
-			b.WriteString(str)
+		if h.Meta.Cache != nil {
+			b.WriteString(generateCachedCall(h, paramInStruct, call))
+		} else {
+			str = `result, err := `
+			if h.ResultType == "" {
+				str = `err = `
+			}
+			b.WriteString(str + call + "\n")
 
 			str = `	if err != nil {
-		switch err.(type) {
-		case ApiError:
-			err.(ApiError).serve(w)
-			return
-		default:
-			errBadUser.serve(w)
-			return
-		}
+		serveMethodError(w, r, ` + h.Meta.errorWriter() + `, srv, err)
+		return
 	}
 `
 			b.WriteString(str)
+		}
+		if h.Paged {
+			str = "serveNextPageLink(w, r, page, result)\n"
+			if h.Meta.Paginate == PaginateCursor && (h.Meta.Envelope == "" || h.Meta.Envelope == EnvelopeLegacy) {
+				str = "nextCursor := " + str
+			}
+			b.WriteString(str)
+		}
 
+		switch {
+		case h.ResultType == "":
+			str = `w.WriteHeader(http.StatusNoContent)`
+		case h.Stream == StreamChan:
+			str = h.Meta.newStream() + `for {
+					select {
+					case <-r.Context().Done():
+						return
+					case item, ok := <-result:
+						if !ok || !stream.write(item) {
+							return
+						}
+					}
+				}`
+		case h.Stream == StreamIter:
+			str = h.Meta.newStream() + `result(func(item ` + h.StreamElem + `) bool {
+					return r.Context().Err() == nil && stream.write(item)
+				})`
+		case h.Stream == StreamIterErr:
+			str = h.Meta.newStream() + `result(func(item ` + h.StreamElem + `, err error) bool {
+					if err != nil {
+						stream.fail(srv, err)
+						return false
+					}
+					return r.Context().Err() == nil && stream.write(item)
+				})`
+		case h.Meta.Envelope == EnvelopeBare:
+			str = h.Meta.serveAnswer("result")
+		case h.Meta.Envelope == EnvelopeCustom:
+			str = h.Meta.serveAnswer("new(" + h.Meta.Wrapper + ").WrapResponse(result)")
+		default:
 			str = `resp := Resp` + h.StructName + strings.Title(h.HandlerMethod) + `{
-				` + h.ResultOut + `:    *` + strings.ToLower(h.ResultOut) + `,
+				Response:   result,
 				EmptyError: "",
 			}
-			serveAnswer(w, resp)`
-			b.WriteString(str + "\n")
+			`
+			if h.Meta.Paginate == PaginateCursor {
+				str += "resp.NextCursor = nextCursor\n"
+			}
+			str += `
+			` + h.Meta.serveAnswer("resp")
 		}
+		b.WriteString(str + "\n")
 		b.WriteString("\n}\n")
+
+		if h.Meta.Cache != nil {
+			generateCacheInvalidation(b, h, paramInStruct)
+		}
 	}
 
 }
 
-//generateHandlers generates ServeHTTP functions
-func generateServeFunc(b *bytes.Buffer, handlers []Handler) {
-	fmt.Println("Generating 'ServeHTTP' functions")
-	//sort handlers
-	sorted := make(map[string][]Handler)
-	for _, h := range handlers {
-		if found, ok := sorted[h.StructName]; ok {
-			found = append(found, h)
-			sorted[h.StructName] = found
-		} else {
-			hCollection := make([]Handler, 0, len(handlers))
-			hCollection = append(hCollection, h)
-			sorted[h.StructName] = hCollection
+//generateCachedCall generates a call of an API method whose results are cached by values of parameters,
+//pages of paginated methods are cached separately
+func generateCachedCall(h Handler, params StructDesc, call string) string {
+	keyArgs := ""
+	for _, field := range h.Meta.Cache.varyFields(h.StructName+"."+h.HandlerMethod, params) {
+		keyArgs += ", " + paramsVar + "." + field.Name
+	}
+	if h.Paged {
+		keyArgs += ", page.Limit, page.Offset, page.Cursor"
+	}
+	ttl := h.Meta.Cache.ttl()
+	return `cacheKey := newCacheKey(srv, ` + strconv.Quote(h.Meta.Url) + keyArgs + `)
+	var result ` + h.ResultType + `
+	if cached, ok := apiCache.lookup(r, cacheKey); ok {
+		result = cached.(` + h.ResultType + `)
+	} else {
+		if result, err = ` + call + `; err != nil {
+			serveMethodError(w, r, ` + h.Meta.errorWriter() + `, srv, err)
+			return
 		}
+		apiCache.store(r, cacheKey, result, time.Duration(` + strconv.FormatInt(int64(ttl), 10) + `))
 	}
+`
+}
 
-	for k, v := range sorted {
+//generateCacheInvalidation generates a method of a receiver which evicts cached results of an endpoint
+//by values of parameters the cache varies by, every page of them is evicted
+func generateCacheInvalidation(b *bytes.Buffer, h Handler, params StructDesc) {
+	name := "Invalidate" + strings.Title(h.HandlerMethod) + "Cache"
+	var args, keyArgs []string
+	for _, field := range h.Meta.Cache.varyFields(h.StructName+"."+h.HandlerMethod, params) {
+		args = append(args, field.localName()+" "+field.goType())
+		keyArgs = append(keyArgs, ", "+field.localName())
+	}
+	str := `
+	//` + name + ` evicts cached results of ` + strconv.Quote(h.Meta.Url) + ` for parameters
+	func (srv *` + h.StructName + `) ` + name + `(` + strings.Join(args, ", ") + `) {
+		apiCache.deletePrefix(newCacheKey(srv, ` + strconv.Quote(h.Meta.Url) + strings.Join(keyArgs, "") + `))
+	}
+`
+	b.WriteString(str)
+}
 
-		serveHandlerPart := "\nfunc (srv *" + k + ") ServeHTTP(w http.ResponseWriter, r *http.Request) { \n" +
-			" switch r.URL.Path {" + "\n"
+//generateParamsBinding generates filling and validation of every field of a structure of parameters.
+//In the "all" errors mode checks of every field are wrapped into a closure:
+//a value which isn't converted to the type of a field or an empty required value
+//skips the rest of checks of the field, other failed checks don't stop anything,
+//and all the failures are reported together
+func generateParamsBinding(b *bytes.Buffer, h Handler, paramInStruct StructDesc) {
+	b.WriteString("var err error\n")
+	if h.Meta.Errors == ErrorsAll {
+		b.WriteString("var fieldErrors []FieldError\n")
+	}
+	for _, field := range paramInStruct.fields {
+		lowFieldName := field.localName()
+		paramName := field.paramName()
+		patterns := 0
+		fail := func(code string, msgID string, args MessageArgs) string {
+			return fieldFailure(h.Meta, paramName, code, msgID, args)
+		}
 
-		for _, h := range v {
+		str := "var " + lowFieldName + " " + field.goType() + "\n"
+		if h.Meta.Errors == ErrorsAll {
+			str += "func() {\n"
+		}
+		b.WriteString(str)
+
+		if field.Type == FieldTypeInt {
+			str = `if raw := r.Form.Get("` + paramName + `"); raw != "" {
+				if ` + lowFieldName + `, err = strconv.Atoi(raw); err != nil {
+					` + fail(ErrorCodeType, MsgTypeInt, nil) + `
+				}
+			}`
+		} else if field.Type == FieldTypeBool {
+			str = `if raw := r.Form.Get("` + paramName + `"); raw != "" {
+				if ` + lowFieldName + `, err = strconv.ParseBool(raw); err != nil {
+					` + fail(ErrorCodeType, MsgTypeBool, nil) + `
+				}
+			}`
+		} else {
+			str = lowFieldName + ` = r.Form.Get("` + paramName + `")`
+		}
+		b.WriteString(str + "\n")
+
+		for _, cond := range field.ConditionsString {
+			if expr, ok := transformExprs[cond.Key]; ok {
+				b.WriteString(lowFieldName + " = " + fmt.Sprintf(expr, lowFieldName) + "\n")
+			}
+			if cond.Key == ValidatorRequired {
+				str = `if ` + lowFieldName + ` == ` + field.zeroValue() + ` {
+					` + fail(cond.Key.String(), MsgRequired, nil) + `
+				}`
+				b.WriteString(str + "\n")
+			}
+			if cond.Key == ValidatorMin {
+				if field.Type == FieldTypeInt {
+					str = `if ` + lowFieldName + ` < ` + cond.Value + ` {
+						` + fail(cond.Key.String(), MsgMin, MessageArgs{"min": cond.Value}) + `
+					}`
+				} else {
+					str = `if ` + field.lengthExpr(lowFieldName) + ` < ` + cond.Value + ` {
+						` + fail(cond.Key.String(), MsgMinLen, MessageArgs{"min": cond.Value}) + `
+					}`
+				}
+				b.WriteString(str + "\n")
+			}
+			if cond.Key == ValidatorMax {
+				if field.Type == FieldTypeInt {
+					str = `if ` + lowFieldName + ` > ` + cond.Value + ` {
+						` + fail(cond.Key.String(), MsgMax, MessageArgs{"max": cond.Value}) + `
+					}`
+				} else {
+					str = `if ` + field.lengthExpr(lowFieldName) + ` > ` + cond.Value + ` {
+						` + fail(cond.Key.String(), MsgMaxLen, MessageArgs{"max": cond.Value}) + `
+					}`
+				}
+				b.WriteString(str + "\n")
+			}
+			if cond.Key == ValidatorLen {
+				str = `if ` + field.lengthExpr(lowFieldName) + ` != ` + cond.Value + ` {
+					` + fail(cond.Key.String(), MsgLen, MessageArgs{"len": cond.Value}) + `
+				}`
+				b.WriteString(str + "\n")
+			}
+			if cond.Key == ValidatorDefault {
+				if field.Type != FieldTypeString {
+					str = `if ` + lowFieldName + ` == ` + field.zeroValue() + ` {
+						` + lowFieldName + ` = ` + cond.Value + `
+					}`
+				} else {
+					str = `if ` + lowFieldName + ` == "" {
+						` + lowFieldName + ` = ` + strconv.Quote(cond.Value) + `
+					}`
+				}
+				b.WriteString(str + "\n")
+			}
+			if cond.Key == ValidatorPattern {
+				str = `if !` + patternVarName(paramInStruct.Name, field.Name, patterns) + `.MatchString(` + lowFieldName + `) {
+					` + fail(cond.Key.String(), MsgPattern, MessageArgs{"pattern": cond.Value}) + `
+				}`
+				b.WriteString(str + "\n")
+				patterns++
+			}
+			if cond.Key == ValidatorCheck {
+				str = `if err := ` + cond.Value + `(` + lowFieldName + `); err != nil {
+					` + fieldFailureMessage(h.Meta, paramName, cond.Value, "err.Error()") + `
+				}`
+				b.WriteString(str + "\n")
+			}
+			if cond.Key == ValidatorFormat {
+				str = `if ` + lowFieldName + ` != "" && !` + formatFuncName(cond.Value) + `(` + lowFieldName + `) {
+					` + fail(cond.Key.String(), MsgFormat, MessageArgs{"format": cond.Value}) + `
+				}`
+				b.WriteString(str + "\n")
+			}
+			if cond.Key == ValidatorEnum {
+				condValues := strings.Split(cond.Value, "|")
+				cases := make([]string, 0, len(condValues))
+				for _, condV := range condValues {
+					if field.Type == FieldTypeInt {
+						cases = append(cases, condV)
+					} else {
+						cases = append(cases, strconv.Quote(condV))
+					}
+				}
+				str = `switch ` + lowFieldName + ` {
+				case ` + strings.Join(cases, ", ") + `:
+				default:
+					` + fail(cond.Key.String(), MsgEnum, MessageArgs{"values": strings.Join(condValues, ", ")}) + `
+				}`
+				b.WriteString(str + "\n")
+			}
+		}
+
+		if h.Meta.Errors == ErrorsAll {
+			b.WriteString("}()\n")
+		}
+		b.WriteString("\n")
+	}
+	generateStructRules(b, h, paramInStruct)
+	if h.Meta.Errors == ErrorsAll {
+		str := `if len(fieldErrors) > 0 {
+			serveFieldErrors(w, r, ` + h.Meta.errorWriter() + `, fieldErrors)
+			return
+		}`
+		b.WriteString(str + "\n")
+	}
+}
+
+//generateStructRules generates cross-field checks of a structure of parameters,
+//they follow checks of the fields. In the "all" errors mode a rule is skipped
+//if any of its fields has failed already, its values can't be compared then
+func generateStructRules(b *bytes.Buffer, h Handler, paramInStruct StructDesc) {
+	for _, rule := range paramInStruct.rules {
+		names := strings.SplitN(rule.Value, structRuleSeparators[rule.Key], 2)
+		left, okLeft := paramInStruct.field(names[0])
+		right, okRight := paramInStruct.field(names[1])
+		if !okLeft || !okRight {
+			log.Fatalf("%s: rule %s=%s refers to a field without 'apivalidator' tag or of a type other than int, string and bool",
+				paramInStruct.Name, rule.Key, rule.Value)
+		}
+		if rule.Key != ValidatorRequiredIf && left.Type != right.Type {
+			log.Fatalf("%s: rule %s=%s compares fields of different types", paramInStruct.Name, rule.Key, rule.Value)
+		}
+		if (rule.Key == ValidatorGtField || rule.Key == ValidatorGteField) && left.Type == FieldTypeBool {
+			log.Fatalf("%s: rule %s=%s can't compare bool fields", paramInStruct.Name, rule.Key, rule.Value)
+		}
+		leftVar, rightVar := left.localName(), right.localName()
+
+		var cond, msgID string
+		switch rule.Key {
+		case ValidatorGtField:
+			cond, msgID = `!(`+leftVar+` > `+rightVar+`)`, MsgGtField
+		case ValidatorGteField:
+			cond, msgID = `!(`+leftVar+` >= `+rightVar+`)`, MsgGteField
+		case ValidatorEqField:
+			cond, msgID = leftVar+` != `+rightVar, MsgEqField
+		case ValidatorRequiredIf:
+			cond, msgID = rightVar+` != `+right.zeroValue()+` && `+leftVar+` == `+left.zeroValue(), MsgRequiredIf
+		}
+		if h.Meta.Errors == ErrorsAll {
+			cond = `!hasFieldError(fieldErrors, ` + strconv.Quote(left.paramName()) + `, ` + strconv.Quote(right.paramName()) + `) && ` + cond
+		}
+		str := `if ` + cond + ` {
+			` + fieldFailure(h.Meta, left.paramName(), rule.Key.String(), msgID, MessageArgs{"field": right.paramName()}) + `
+		}`
+		b.WriteString(str + "\n")
+	}
+}
+
+//fieldFailure returns a code reporting a failed check of a parameter.
+//The first failure stops a handler by default, the "all" errors mode collects it instead
+//and stops checks of the field only if it has no usable value
+func fieldFailure(meta HandlerApiGenComment, paramName string, code string, msgID string, args MessageArgs) string {
+	return fieldFailureMessage(meta, paramName, code, localizeCall(paramName, msgID, args))
+}
+
+//fieldFailureMessage works like fieldFailure with an expression of a message given
+func fieldFailureMessage(meta HandlerApiGenComment, paramName string, code string, message string) string {
+	if meta.Errors == ErrorsAll {
+		str := `fieldErrors = append(fieldErrors, FieldError{Param: ` + strconv.Quote(paramName) +
+			`, Code: ` + strconv.Quote(code) + `, Message: ` + message + `})`
+		if code == ErrorCodeType || code == ValidatorRequired.String() {
+			str += "\nreturn"
+		}
+		return str
+	}
+	return meta.writeError(`newParamError(`+strconv.Quote(paramName)+`, `+strconv.Quote(code)+`, `+message+`)`) + `
+		return`
+}
+
+//localizeCall returns a call of 'localize' resolving a message of a parameter at runtime
+func localizeCall(paramName string, msgID string, args MessageArgs) string {
+	all := MessageArgs{"param": paramName}
+	for k, v := range args {
+		all[k] = v
+	}
+	keys := make([]string, 0, len(all))
+	for k := range all {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	str := `localize(r, ` + strconv.Quote(msgID) + `, map[string]string{`
+	for _, k := range keys {
+		str += strconv.Quote(k) + `: ` + strconv.Quote(all[k]) + `, `
+	}
+	return str + `})`
+}
+
+//generateHandlers generates ServeHTTP functions
+func generateServeFunc(b *bytes.Buffer, handlers []Handler, receivers map[string]HandlerApiGenComment) {
+	fmt.Println("Generating 'ServeHTTP' functions")
+	//sort handlers
+	sorted := make(map[string][]Handler)
+	for _, h := range handlers {
+		if found, ok := sorted[h.StructName]; ok {
+			found = append(found, h)
+			sorted[h.StructName] = found
+		} else {
+			hCollection := make([]Handler, 0, len(handlers))
+			hCollection = append(hCollection, h)
+			sorted[h.StructName] = hCollection
+		}
+	}
+
+	for k, v := range sorted {
+
+		serveHandlerPart := "\nfunc (srv *" + k + ") ServeHTTP(w http.ResponseWriter, r *http.Request) { \n" +
+			" switch r.URL.Path {" + "\n"
+
+		for _, h := range v {
 			serveHandlerPart += "case \"" + h.Meta.Url + "\":\n"
 			serveHandlerPart += "srv." + h.HandlerMethod + "(w, r)\n"
 		}
-		serveHandlerPart += "default:\nerrUnknown.serve(w)\nreturn\n}} \n"
+		serveHandlerPart += "default:\n" + receivers[k].writeError("errUnknown") + "\nreturn\n}} \n"
 		b.WriteString(serveHandlerPart)
 
 	}
@@ -402,6 +1230,9 @@ The end of "Responses Structures" section
 	w := bufio.NewWriter(buf)
 	_, _ = w.WriteString(beginning)
 	for _, h := range handlers {
+		if h.ResultType == "" || h.Stream != StreamNone || h.Meta.Envelope != "" && h.Meta.Envelope != EnvelopeLegacy {
+			continue
+		}
 		if err := structRespTpl.Execute(w, h); err != nil {
 			fmt.Println("Unexpected error: ", err.Error(), "while using handler: ", h)
 			return
@@ -425,67 +1256,187 @@ func gatherInfoStruct(a *ast.GenDecl, apiDesc *ApiDesc) {
 		if !ok {
 			continue
 		}
-		gatherInfoFields(currStruct, currType, apiDesc)
+		doc := currType.Doc
+		if doc == nil {
+			doc = a.Doc
+		}
+		gatherInfoReceiver(doc, currType, apiDesc)
+		gatherInfoFields(currStruct, currType, doc, apiDesc)
+	}
+}
+
+//gatherInfoReceiver collects options of a receiver from its 'apigen:api' commentary,
+//they are used by every endpoint of the receiver which doesn't set them itself
+func gatherInfoReceiver(doc *ast.CommentGroup, currType *ast.TypeSpec, apiDesc *ApiDesc) {
+	if doc == nil {
+		return
+	}
+	for _, comment := range doc.List {
+		var meta HandlerApiGenComment
+		if parseApiGenComment(comment.Text, &meta) {
+			apiDesc.receivers[currType.Name.Name] = meta
+		}
+	}
+}
+
+//applyReceiverMeta fills options of handlers from options of their receivers
+func applyReceiverMeta(apiDesc *ApiDesc) {
+	for name, meta := range apiDesc.receivers {
+		meta.verify(name)
+	}
+	for i, h := range apiDesc.handlers {
+		apiDesc.handlers[i].Meta = h.Meta.inherit(apiDesc.receivers[h.StructName])
+		apiDesc.handlers[i].Meta.verify(h.StructName + "." + h.HandlerMethod)
+	}
+}
+
+//parseApiGenComment parses a json following an 'apigen:api' mark
+func parseApiGenComment(text string, meta *HandlerApiGenComment) bool {
+	if !strings.HasPrefix(text, "// apigen:api") {
+		return false
+	}
+	//options of wrong types or with unknown names would be dropped silently otherwise
+	decoder := json.NewDecoder(strings.NewReader(strings.TrimPrefix(text, "// apigen:api")))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(meta); err != nil {
+		log.Fatalf("can't parse 'apigen:api' commentary %q: %v", text, err)
 	}
+	return true
 }
 
 //gatherInfoFields gathers information about fields of structures
-func gatherInfoFields(currStruct *ast.StructType, currType *ast.TypeSpec, apiDesc *ApiDesc) {
+func gatherInfoFields(currStruct *ast.StructType, currType *ast.TypeSpec, doc *ast.CommentGroup, apiDesc *ApiDesc) {
 	var newStr *StructDesc = nil
+	getStr := func() *StructDesc {
+		if newStr == nil {
+			if found, ok := apiDesc.structs[currType.Name.Name]; !ok {
+				newStr = &StructDesc{Name: currType.Name.Name}
+			} else {
+				newStr = &found
+			}
+		}
+		return newStr
+	}
+
+	if doc != nil {
+		for _, comment := range doc.List {
+			if strings.HasPrefix(comment.Text, "// apivalidator:") {
+				parseStructRules(getStr(), strings.TrimSpace(strings.TrimPrefix(comment.Text, "// apivalidator:")))
+			}
+		}
+	}
 
 	for _, field := range currStruct.Fields.List {
-		if field.Tag != nil {
-			tagValue := ""
-			if strings.HasPrefix(field.Tag.Value, "`apivalidator:") {
-				tagValue = strings.TrimLeft(field.Tag.Value, "`apivalidator:")
-				if newStr == nil {
-					if found, ok := apiDesc.structs[currType.Name.Name]; !ok {
-						newStr = &StructDesc{Name: currType.Name.Name}
-					} else {
-						newStr = &found
-					}
-				}
-			} else {
+		if field.Tag != nil && len(field.Names) > 0 {
+			tag, err := strconv.Unquote(field.Tag.Value)
+			if err != nil {
 				continue
 			}
-			fType := FieldTypeUnknown
-			if field.Type.(*ast.Ident).Name == "int" {
-				fType = FieldTypeInt
-			} else if field.Type.(*ast.Ident).Name == "string" {
-				fType = FieldTypeString
-			} else {
-				continue
+			if tagValue, ok := reflect.StructTag(tag).Lookup("apivalidator"); ok {
+				if field.Names[0].Name == "_" {
+					parseStructRules(getStr(), tagValue)
+					continue
+				}
+				getStr()
+				fType := FieldTypeUnknown
+				if ident, ok := field.Type.(*ast.Ident); !ok {
+					continue
+				} else if ident.Name == "int" {
+					fType = FieldTypeInt
+				} else if ident.Name == "string" {
+					fType = FieldTypeString
+				} else if ident.Name == "bool" {
+					fType = FieldTypeBool
+				} else {
+					continue
+				}
+				parseTagValue(newStr, field.Names[0].Name, fType, tagValue)
 			}
-			parseTagValue(newStr, field.Names[0].Name, fType, tagValue)
 		}
-		if newStr != nil && len(newStr.fields) > 0 {
-			apiDesc.structs[currType.Name.Name] = *newStr
+	}
+	if newStr != nil && len(newStr.fields) > 0 {
+		apiDesc.structs[currType.Name.Name] = *newStr
+	}
+}
+
+//parseStructRules parses cross-field rules of a structure
+//from 'apivalidator' tag of a blank field or from '// apivalidator:' commentary
+func parseStructRules(strDesc *StructDesc, value string) {
+	for _, rule := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(rule), "=", 2)
+		if len(kv) != 2 {
+			log.Fatalf("%s: bad rule %q", strDesc.Name, rule)
 		}
+		key := ValidatorAction(kv[0])
+		sep, ok := structRuleSeparators[key]
+		if !ok {
+			log.Fatalf("%s: unknown rule %q", strDesc.Name, rule)
+		}
+		if len(strings.SplitN(kv[1], sep, 2)) != 2 {
+			log.Fatalf("%s: rule %q must look like %s=A%sB", strDesc.Name, rule, key, sep)
+		}
+		strDesc.rules = append(strDesc.rules, ConditionString{Key: key, Value: kv[1]})
 	}
 }
 
 //parseTagValue parses values of 'apivalidator' tags
 func parseTagValue(strDesc *StructDesc, fieldName string, fType FieldType, tagValue string) {
-	conditions := strings.Split(strings.Trim(strings.Trim(tagValue, "/`"), "\""), ",")
+	conditions := splitConditions(tagValue)
 	field := FieldDesc{Type: fType, Name: fieldName}
 	for _, condition := range conditions {
-		kv := strings.Split(condition, "=")
+		kv := strings.SplitN(condition, "=", 2)
 		if len(kv) == 1 { //one key only
 			if kv[0] == ValidatorRequired.String() {
 				field.ConditionsString = append(field.ConditionsString, ConditionString{Key: ValidatorRequired})
-			} else {
-				fmt.Println("Unknown condition: ", condition)
-				continue
+			} else if kv[0] == ValidatorBytes.String() {
+				field.ConditionsString = append(field.ConditionsString, ConditionString{Key: ValidatorBytes})
+			} else if _, ok := transformExprs[ValidatorAction(kv[0])]; ok {
+				if fType != FieldTypeString {
+					log.Fatalf("%s: '%s' can be used with strings only", fieldName, kv[0])
+				}
+				field.ConditionsString = append(field.ConditionsString, ConditionString{Key: ValidatorAction(kv[0])})
+			} else if kv[0] != "" {
+				log.Fatalf("%s: unknown condition %q", fieldName, condition)
 			}
 		} else if len(kv) == 2 { //a pair of key/value
 			k, v := kv[0], kv[1]
 
+			if fType == FieldTypeBool {
+				switch ValidatorAction(k) {
+				case ValidatorEnum, ValidatorEnumType, ValidatorMin, ValidatorMax:
+					log.Fatalf("%s: '%s' can't be used with bool fields", fieldName, k)
+				case ValidatorDefault:
+					b, err := strconv.ParseBool(v)
+					if err != nil {
+						log.Fatalf("%s: 'default' of bool field has not bool value %q", fieldName, v)
+					}
+					v = strconv.FormatBool(b)
+				}
+			}
+
 			switch k {
 
 			case ValidatorParamName.String():
 				field.ConditionsString = append(field.ConditionsString, ConditionString{Key: ValidatorParamName, Value: v})
 			case ValidatorEnum.String():
+				seen := make(map[string]bool)
+				for _, enumV := range strings.Split(v, "|") {
+					key := enumV
+					if fType == FieldTypeInt {
+						n, err := strconv.Atoi(enumV)
+						if err != nil {
+							log.Fatalf("%s: 'enum' of int field has not int value %q", fieldName, enumV)
+						}
+						key = strconv.Itoa(n)
+					}
+					if seen[key] {
+						log.Fatalf("%s: 'enum' repeats value %q", fieldName, enumV)
+					}
+					seen[key] = true
+				}
 				field.ConditionsString = append(field.ConditionsString, ConditionString{Key: ValidatorEnum, Value: v})
+			case ValidatorEnumType.String():
+				field.ConditionsString = append(field.ConditionsString, ConditionString{Key: ValidatorEnumType, Value: v})
 			case ValidatorDefault.String():
 				field.ConditionsString = append(field.ConditionsString, ConditionString{Key: ValidatorDefault, Value: v})
 			case ValidatorMin.String():
@@ -494,23 +1445,59 @@ func parseTagValue(strDesc *StructDesc, fieldName string, fType FieldType, tagVa
 				field.ConditionsString = append(field.ConditionsString, ConditionString{Key: ValidatorMax, Value: v})
 			case ValidatorRequired.String():
 				field.ConditionsString = append(field.ConditionsString, ConditionString{Key: ValidatorRequired, Value: v})
+			case ValidatorPattern.String():
+				if fType != FieldTypeString {
+					log.Fatalf("%s: 'pattern' can be used with strings only", fieldName)
+				}
+				if _, err := regexp.Compile(v); err != nil {
+					log.Fatalf("%s: bad pattern %q: %v", fieldName, v, err)
+				}
+				field.ConditionsString = append(field.ConditionsString, ConditionString{Key: ValidatorPattern, Value: v})
+			case ValidatorLen.String():
+				if fType != FieldTypeString {
+					log.Fatalf("%s: 'len' can be used with strings only", fieldName)
+				}
+				field.ConditionsString = append(field.ConditionsString, ConditionString{Key: ValidatorLen, Value: v})
+			case ValidatorCheck.String():
+				field.ConditionsString = append(field.ConditionsString, ConditionString{Key: ValidatorCheck, Value: v})
+			case ValidatorFormat.String():
+				if fType != FieldTypeString {
+					log.Fatalf("%s: 'format' can be used with strings only", fieldName)
+				}
+				if _, ok := formatCheckers[v]; !ok {
+					log.Fatalf("%s: unknown format %q", fieldName, v)
+				}
+				field.ConditionsString = append(field.ConditionsString, ConditionString{Key: ValidatorFormat, Value: v})
 			default:
-				field.ConditionsString = append(field.ConditionsString, ConditionString{Key: ValidatorUndef, Value: v})
-
+				log.Fatalf("%s: unknown condition %q", fieldName, condition)
 			}
 		} else { // an unknown case
 			fmt.Println("Unknown condition: ", condition)
 			continue
 		}
 	}
-	if len(field.ConditionsString) > 0 {
-		sort.Slice(field.ConditionsString, func(i, j int) bool {
-			return field.ConditionsString[i].Key.Order() < field.ConditionsString[j].Key.Order()
-		})
-		strDesc.fields = append(strDesc.fields, field)
-	} else {
-		fmt.Println("empty field: ", field)
+	//a field with an empty tag is bound without checks, e.g. to be used by cross-field rules
+	sort.SliceStable(field.ConditionsString, func(i, j int) bool {
+		return field.ConditionsString[i].Key.Order() < field.ConditionsString[j].Key.Order()
+	})
+	strDesc.fields = append(strDesc.fields, field)
+}
+
+//splitConditions splits a value of 'apivalidator' tag by commas.
+//A comma of a pattern (like in "{1,3}") is kept while it isn't followed by a known key
+func splitConditions(tagValue string) []string {
+	var conditions []string
+	for _, part := range strings.Split(tagValue, ",") {
+		n := len(conditions)
+		key := strings.SplitN(part, "=", 2)[0]
+		if _, known := validatorActions[key]; !known && n > 0 &&
+			strings.HasPrefix(conditions[n-1], ValidatorPattern.String()+"=") {
+			conditions[n-1] += "," + part
+			continue
+		}
+		conditions = append(conditions, part)
 	}
+	return conditions
 }
 
 //gatherInfoFunc collects information with 'apigen:api' commentaries
@@ -518,17 +1505,16 @@ func gatherInfoFunc(f *ast.FuncDecl, a *ApiDesc) {
 
 	h := Handler{}
 
+	gatherInfoValidateMethod(f, a)
+	gatherInfoCheckFunc(f, a)
 	if f.Doc == nil {
 		return
 	}
 	for _, comment := range f.Doc.List {
-		if strings.HasPrefix(comment.Text, "// apigen:api") {
+		if parseApiGenComment(comment.Text, &h.Meta) {
 
 			h.HandlerMethod = strings.ToLower(f.Name.Name)
 
-			apigenDoc := []byte(strings.TrimLeft(comment.Text, "// apigen:api"))
-			_ = json.Unmarshal(apigenDoc, &h.Meta)
-
 			if f.Recv != nil {
 				switch a := f.Recv.List[0].Type.(type) {
 				case *ast.StarExpr:
@@ -540,16 +1526,34 @@ func gatherInfoFunc(f *ast.FuncDecl, a *ApiDesc) {
 				for _, p := range f.Type.Params.List {
 					switch a := p.Type.(type) {
 					case *ast.Ident:
-						h.ParamIn = a.Name
+						if h.ParamIn == "" {
+							h.ParamIn = a.Name
+						} else if a.Name == "Page" {
+							h.Paged = true
+						}
+					case *ast.FuncType:
+						if elem, ok := detectSendFunc(a); ok {
+							h.Stream, h.StreamElem = StreamSend, elem
+						}
 					}
 				}
 			}
 
-			if f.Type.Results.List != nil && len(f.Type.Results.List) != 0 {
-				switch a := f.Type.Results.List[0].Type.(type) {
-				case *ast.StarExpr:
-					h.ResultOut = a.X.(*ast.Ident).Name
-				}
+			if results := fieldListTypes(f.Type.Results); len(results) > 1 {
+				h.ResultType = types.ExprString(results[0])
+				h.Stream, h.StreamElem = detectStream(results[0])
+			}
+			if h.Meta.Stream != "" && h.Stream == StreamNone {
+				log.Fatalf("%s.%s: %q stream needs a channel, an iterator or a send function", h.StructName, f.Name.Name, h.Meta.Stream)
+			}
+			if (h.Meta.Paginate != "") != h.Paged || h.Paged && h.Stream != StreamNone {
+				log.Fatalf("%s.%s: 'paginate' option needs 'Page' parameter and a result which is not streamed", h.StructName, f.Name.Name)
+			}
+			if h.Meta.Idempotent && (h.Meta.Method != "POST" || h.Stream != StreamNone) {
+				log.Fatalf("%s.%s: 'idempotent' option is for POST endpoints which aren't streamed", h.StructName, f.Name.Name)
+			}
+			if h.Meta.Cache != nil && (h.ResultType == "" || h.Stream != StreamNone || h.Meta.Method == "POST") {
+				log.Fatalf("%s.%s: 'cache' option needs a result which is not streamed and an endpoint which isn't POST", h.StructName, f.Name.Name)
 			}
 
 			a.handlers = append(a.handlers, h)
@@ -558,109 +1562,1963 @@ func gatherInfoFunc(f *ast.FuncDecl, a *ApiDesc) {
 
 }
 
-//generateAuxiliaryFunctionsSection appends to *bytes.Buffer auxiliary functions
-func generateAuxiliaryFunctionsSection(buf *bytes.Buffer) {
-	fmt.Println("Generating auxiliary functions")
-	errSection := `/*
-"Auxiliary functions" section
-Beginning of "Auxiliary functions" section
-*/
-
-func serveAnswer(w http.ResponseWriter, v interface{}) {
-	data, _ := json.Marshal(v)
-	w.Header().Set("Content-Type", http.DetectContentType(data))
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(data)
-}
-/*
-The end of "Auxiliary functions" section
-*/
-`
-	_, _ = buf.WriteString("\n" + errSection + "\n\n")
+//gatherInfoPackageFuncs collects check functions and 'Validate' methods
+//from other files of the package of the parsed file, the generated file and tests are skipped
+func gatherInfoPackageFuncs(fset *token.FileSet, a *ApiDesc) {
+	dir := filepath.Dir(os.Args[1])
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") || sameFile(file, os.Args[1]) || sameFile(file, os.Args[2]) {
+			continue
+		}
+		if match, err := build.Default.MatchFile(dir, filepath.Base(file)); err != nil || !match {
+			continue
+		}
+		node, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, decl := range node.Decls {
+			if f, ok := decl.(*ast.FuncDecl); ok {
+				gatherInfoValidateMethod(f, a)
+				gatherInfoCheckFunc(f, a)
+			}
+		}
+	}
 }
 
-//generateApiErrorsSection appends to *bytes.Buffer Hardcoded Well-known Errors Section
-func generateApiErrorsSection(buf *bytes.Buffer) {
-	fmt.Println("Generating 'Hardcoded Well-known Errors' Section")
-	errSection := `/*
-"Hardcoded Well-known Errors" section
-Beginning of "Hardcoded Well-known Errors" section
-*/
-
-var (
-	errUnknown      = ApiError{HTTPStatus: http.StatusNotFound, Err: errors.New("unknown method")}
-	errBadMethod    = ApiError{HTTPStatus: http.StatusNotAcceptable, Err: errors.New("bad method")}
-	errEmptyLogin   = ApiError{HTTPStatus: http.StatusBadRequest, Err: errors.New("login must me not empty")}
-	errBadUser      = ApiError{HTTPStatus: http.StatusInternalServerError, Err: errors.New("bad user")}
-	errUnauthorized = ApiError{HTTPStatus: http.StatusForbidden, Err: errors.New("unauthorized")}
-)
-/*
-The end of "Hardcoded Well-known Errors" section
-*/
-`
-	_, _ = buf.WriteString("\n" + errSection + "\n\n")
+//sameFile reports whether two paths point to the same existing file
+func sameFile(a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	return err == nil && os.SameFile(aInfo, bInfo)
 }
 
-//formatCode works like 'gofmt' command and formats a text in *bytes.Buffer
-func formatCode(buf *bytes.Buffer) {
-	fmt.Println("Formatting the code")
-	b, err := format.Source(buf.Bytes())
-	if err != nil {
-		fmt.Println("Can't format: ", err.Error())
+//gatherInfoValidateMethod remembers types having 'Validate(ctx context.Context) error' method,
+//their values are validated by it after the checks of 'apivalidator' tags
+func gatherInfoValidateMethod(f *ast.FuncDecl, a *ApiDesc) {
+	if f.Recv == nil || f.Name.Name != "Validate" {
 		return
 	}
-	buf.Reset()
-	buf.WriteString(string(b))
+	recvType := f.Recv.List[0].Type
+	if star, ok := recvType.(*ast.StarExpr); ok {
+		recvType = star.X
+	}
+	recv, ok := recvType.(*ast.Ident)
+	if !ok {
+		return
+	}
+	params, results := f.Type.Params.List, f.Type.Results
+	if len(params) != 1 || len(params[0].Names) > 1 || results == nil || len(results.List) != 1 || len(results.List[0].Names) > 1 {
+		return
+	}
+	ctxType, ok := params[0].Type.(*ast.SelectorExpr)
+	if !ok || ctxType.Sel.Name != "Context" {
+		return
+	}
+	if pkg, ok := ctxType.X.(*ast.Ident); !ok || pkg.Name != "context" {
+		return
+	}
+	if errType, ok := results.List[0].Type.(*ast.Ident); !ok || errType.Name != "error" {
+		return
+	}
+	a.validated[recv.Name] = true
 }
 
-//generateImportSection appends dependencies to *bytes.Buffer
-func generateImportSection(buf *bytes.Buffer, packageName string) {
-	fmt.Println("Generating 'Import' Section")
-	imports := []string{
-		"encoding/json",
-		"errors",
-		"fmt",
-		"net/http",
-		"strconv",
+//gatherInfoCheckFunc remembers functions like 'func(string) error', 'func(int) error' or 'func(bool) error'
+//of any file of the package which can be used by 'check' validator of fields of the same type
+func gatherInfoCheckFunc(f *ast.FuncDecl, a *ApiDesc) {
+	if f.Recv != nil {
+		return
 	}
-	_, _ = buf.WriteString("package " + packageName + "\n")
-	_, _ = buf.WriteString("import (\n")
-	for _, impItem := range imports {
-		_, _ = buf.WriteString("\"" + impItem + "\"\n")
+	params, results := f.Type.Params.List, f.Type.Results
+	if len(params) != 1 || len(params[0].Names) > 1 || results == nil || len(results.List) != 1 || len(results.List[0].Names) > 1 {
+		return
+	}
+	if errType, ok := results.List[0].Type.(*ast.Ident); !ok || errType.Name != "error" {
+		return
+	}
+	if argType, ok := params[0].Type.(*ast.Ident); ok {
+		switch argType.Name {
+		case "int":
+			a.checks[f.Name.Name] = FieldTypeInt
+		case "string":
+			a.checks[f.Name.Name] = FieldTypeString
+		case "bool":
+			a.checks[f.Name.Name] = FieldTypeBool
+		}
 	}
-	_, _ = buf.WriteString(")\n\n")
-
 }
 
-//generateApiErrorsSection appends to *bytes.Buffer Hardcoded Well-known Errors Section
-func generateApiErrorsFuncSection(buf *bytes.Buffer) {
-	fmt.Println("Generating 'Functions Of ApiError' Section")
-	_, _ = buf.WriteString("\n")
-	errFuncSection := `
-	/*
-	"Functions Of ApiError" section -
-	there are additional methods for well-known ApiError
-	to eliminate some doubled code
-
-	Beginning of "Functions Of ApiError" section
-	*/
-
-	func NewApiError(text string, httpStatus int) *ApiError {
-		return &ApiError{HTTPStatus: httpStatus, Err: errors.New(text)}
+//verifyChecks stops the generation if 'check' validator uses an unknown function
+//or a function which doesn't accept a value of a field
+func verifyChecks(apiDesc ApiDesc) {
+	for _, str := range apiDesc.structs {
+		for _, field := range str.fields {
+			for _, cond := range field.ConditionsString {
+				if cond.Key != ValidatorCheck {
+					continue
+				}
+				fType, ok := apiDesc.checks[cond.Value]
+				if !ok {
+					log.Fatalf("%s.%s: unknown check %q, it must be a function like 'func(string) error', 'func(int) error' or 'func(bool) error'", str.Name, field.Name, cond.Value)
+				}
+				if fType != field.Type {
+					log.Fatalf("%s.%s: check %q doesn't accept a value of the field", str.Name, field.Name, cond.Value)
+				}
+			}
+		}
+	}
+}
+
+//collectTypedConstants evaluates constants of the parsed file and groups them by names of their types.
+//Imports of the file aren't resolved, they are not needed by constants declared in the file
+func collectTypedConstants(fset *token.FileSet, node *ast.File) map[string][]*types.Const {
+	conf := types.Config{Error: func(err error) {}}
+	pkg, _ := conf.Check(node.Name.Name, fset, []*ast.File{node}, nil)
+	constants := make(map[string][]*types.Const)
+	if pkg == nil {
+		return constants
+	}
+	scope := pkg.Scope()
+	for _, name := range scope.Names() {
+		c, ok := scope.Lookup(name).(*types.Const)
+		if !ok {
+			continue
+		}
+		if named, ok := c.Type().(*types.Named); ok {
+			constants[named.Obj().Name()] = append(constants[named.Obj().Name()], c)
+		}
+	}
+	for _, list := range constants {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Pos() < list[j].Pos()
+		})
+	}
+	return constants
+}
+
+//resolveEnumTypes replaces 'enumtype' validators by 'enum' ones with values of typed constants
+func resolveEnumTypes(apiDesc *ApiDesc) {
+	for name, str := range apiDesc.structs {
+		for _, field := range str.fields {
+			for i, cond := range field.ConditionsString {
+				if cond.Key != ValidatorEnumType {
+					continue
+				}
+				constants, ok := apiDesc.constants[cond.Value]
+				if !ok {
+					log.Fatalf("%s.%s: there are no constants of type %q", name, field.Name, cond.Value)
+				}
+				values := make([]string, 0, len(constants))
+				seen := make(map[string]bool)
+				for _, c := range constants {
+					var value string
+					switch {
+					case field.Type == FieldTypeInt && c.Val().Kind() == constant.Int:
+						value = c.Val().ExactString()
+					case field.Type == FieldTypeString && c.Val().Kind() == constant.String:
+						value = constant.StringVal(c.Val())
+					default:
+						log.Fatalf("%s.%s: constant %s doesn't match a type of the field", name, field.Name, c.Name())
+					}
+					//constants like an alias of a default value share values, a switch can't repeat them
+					if !seen[value] {
+						seen[value] = true
+						values = append(values, value)
+					}
+				}
+				field.ConditionsString[i] = ConditionString{Key: ValidatorEnum, Value: strings.Join(values, "|")}
+			}
+		}
+	}
+}
+
+//addUntaggedParamStructs adds descriptions of structures of parameters without tagged fields,
+//handlers of them call methods with empty structures
+func addUntaggedParamStructs(apiDesc *ApiDesc) {
+	for _, h := range apiDesc.handlers {
+		if _, ok := apiDesc.structs[h.ParamIn]; !ok {
+			apiDesc.structs[h.ParamIn] = StructDesc{Name: h.ParamIn}
+		}
+	}
+}
+
+//applyValidateMethods marks structures of parameters having 'Validate' method
+func applyValidateMethods(apiDesc *ApiDesc) {
+	for name, str := range apiDesc.structs {
+		str.validate = apiDesc.validated[name]
+		apiDesc.structs[name] = str
+	}
+}
+
+//patternVarName returns a name of a package-level variable with the n-th precompiled pattern of a field
+func patternVarName(structName string, fieldName string, n int) string {
+	if n == 0 {
+		return "pattern" + structName + fieldName
+	}
+	return "pattern" + structName + fieldName + strconv.Itoa(n)
+}
+
+//generatePatternsSection appends to *bytes.Buffer patterns of fields compiled once
+func generatePatternsSection(buf *bytes.Buffer, structs map[string]StructDesc) {
+	fmt.Println("Generating 'Patterns' Section")
+	names := make([]string, 0, len(structs))
+	for name := range structs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vars := ""
+	for _, name := range names {
+		for _, field := range structs[name].fields {
+			patterns := 0
+			for _, cond := range field.ConditionsString {
+				if cond.Key == ValidatorPattern {
+					vars += patternVarName(name, field.Name, patterns) + " = regexp.MustCompile(" + strconv.Quote(cond.Value) + ")\n"
+					patterns++
+				}
+			}
+		}
+	}
+	if vars == "" {
+		return
+	}
+	_, _ = buf.WriteString("\nvar (\n" + vars + ")\n\n")
+}
+
+type formatChecker struct {
+	imports []string
+	code    string
+}
+
+//formatCheckers are bodies of functions 'func(s string) bool' checking values of 'format' validators
+var formatCheckers = map[string]formatChecker{
+	"email": {imports: []string{"net/mail"}, code: `
+		addr, err := mail.ParseAddress(s)
+		return err == nil && addr.Address == s`},
+	"url": {imports: []string{"net/url"}, code: `
+		u, err := url.Parse(s)
+		return err == nil && u.Scheme != "" && u.Host != ""`},
+	"uuid": {code: `
+		if len(s) != 36 {
+			return false
+		}
+		for i, c := range s {
+			switch {
+			case i == 8 || i == 13 || i == 18 || i == 23:
+				if c != '-' {
+					return false
+				}
+			case !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'):
+				return false
+			}
+		}
+		return true`},
+	"ipv4": {imports: []string{"net"}, code: `
+		ip := net.ParseIP(s)
+		return ip != nil && ip.To4() != nil && !strings.Contains(s, ":")`},
+	"ipv6": {imports: []string{"net"}, code: `
+		return net.ParseIP(s) != nil && strings.Contains(s, ":")`},
+	"hostname": {code: `
+		if len(s) == 0 || len(s) > 253 {
+			return false
+		}
+		for _, label := range strings.Split(strings.TrimSuffix(s, "."), ".") {
+			if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+				return false
+			}
+			for _, c := range label {
+				if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '-') {
+					return false
+				}
+			}
+		}
+		return true`},
+	"date": {imports: []string{"time"}, code: `
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil`},
+}
+
+//formatFuncName returns a name of a function of the generated code checking a format
+func formatFuncName(format string) string {
+	return "isFormat" + strings.Title(format)
+}
+
+//generateFormatsSection appends to *bytes.Buffer functions checking formats which are used by fields
+func generateFormatsSection(buf *bytes.Buffer, structs map[string]StructDesc) {
+	fmt.Println("Generating 'Formats' Section")
+	used := make(map[string]bool)
+	for _, str := range structs {
+		for _, field := range str.fields {
+			for _, cond := range field.ConditionsString {
+				if cond.Key == ValidatorFormat {
+					used[cond.Value] = true
+				}
+			}
+		}
+	}
+	formats := make([]string, 0, len(used))
+	for format := range used {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	for _, format := range formats {
+		_, _ = buf.WriteString("\nfunc " + formatFuncName(format) + "(s string) bool {" +
+			formatCheckers[format].code + "\n}\n")
+	}
+}
+
+//collectImports returns dependencies which are needed by checks of fields only
+func collectImports(structs map[string]StructDesc) []string {
+	var imports []string
+	for _, str := range structs {
+		for _, field := range str.fields {
+			if field.countsRunes() {
+				imports = append(imports, "unicode/utf8")
+			}
+			for _, cond := range field.ConditionsString {
+				if cond.Key == ValidatorPattern {
+					imports = append(imports, "regexp")
+				}
+				if cond.Key == ValidatorFormat {
+					imports = append(imports, formatCheckers[cond.Value].imports...)
+				}
+			}
+		}
+	}
+	return imports
+}
+
+//generateAuxiliaryFunctionsSection appends to *bytes.Buffer auxiliary functions
+func generateAuxiliaryFunctionsSection(buf *bytes.Buffer) {
+	fmt.Println("Generating auxiliary functions")
+	errSection := `/*
+"Auxiliary functions" section
+Beginning of "Auxiliary functions" section
+*/
+
+//contentTypeJSON is a type of every JSON response except problem details
+const contentTypeJSON = "application/json; charset=utf-8"
+
+//answerOptions are options of an endpoint which change its successful responses
+type answerOptions struct {
+	compress bool
+	//cacheControl is sent with responses to requests which can be served from the cache
+	cacheControl string
+}
+
+//serveAnswer writes a response encoded by an encoder acceptable for a request,
+//the request gets 406 if no acceptable encoder can encode the response.
+//Compressed responses are compressed by 'Accept-Encoding' header if they aren't too small
+func serveAnswer(w http.ResponseWriter, r *http.Request, errs errorWriter, v interface{}, options answerOptions) {
+	w.Header().Add("Vary", "Accept")
+	encoder, data := negotiateEncoder(r, v)
+	if encoder == nil {
+		errs.writeError(w, r, errNotAcceptable, nil)
+		return
+	}
+	setContentType(w, encoder.ContentType())
+	if options.cacheControl != "" && cacheableRequest(r) {
+		w.Header().Set("Cache-Control", options.cacheControl)
+	}
+	if options.compress {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if rec, ok := w.(*responseRecorder); ok {
+			rec.uncompressed = data
+		}
+		data = compressAnswer(w, r, data)
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		etag := answerETag(v, data)
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag, true) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+//ETagger can be implemented by results to be tagged by versions instead of hashes of responses,
+//the version is sent as is for every representation of a result
+type ETagger interface {
+	ETag() string
+}
+
+//CurrentETagger can be implemented by a receiver to support 'If-Match' header by its mutating endpoints,
+//CurrentETag returns an ETag of a resource which is changed by parameters or "" if there is no such resource
+type CurrentETagger interface {
+	CurrentETag(r *http.Request, params interface{}) (string, error)
+}
+
+//answerETag returns a strong ETag of a result or of its encoded response
+func answerETag(v interface{}, data []byte) string {
+	if p, ok := v.(payloader); ok {
+		v = p.payload()
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() != reflect.Ptr || !rv.IsNil() {
+		if tagger, ok := v.(ETagger); ok && tagger.ETag() != "" {
+			return quoteETag(tagger.ETag())
+		}
+	}
+	sum := sha256.Sum256(data)
+	return quoteETag(hex.EncodeToString(sum[:16]))
+}
+
+//quoteETag makes an entity tag of a version unless it's an entity tag already
+func quoteETag(tag string) string {
+	if strings.HasPrefix(tag, "W/") || len(tag) > 1 && strings.HasPrefix(tag, "\"") && strings.HasSuffix(tag, "\"") {
+		return tag
+	}
+	return "\"" + tag + "\""
+}
+
+//etagMatches reports whether an 'If-Match' or 'If-None-Match' header has an ETag,
+//the weak comparison ignores "W/" prefixes and the strong one never matches weak tags
+func etagMatches(header string, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag && !strings.HasPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+//checkIfMatch returns errPreconditionFailed if a mutating request has 'If-Match' header
+//which doesn't match an ETag of the current resource of a receiver
+func checkIfMatch(r *http.Request, receiver interface{}, params interface{}) error {
+	header := r.Header.Get("If-Match")
+	tagger, ok := receiver.(CurrentETagger)
+	if header == "" || !ok || r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return nil
+	}
+	current, err := tagger.CurrentETag(r, params)
+	if err != nil {
+		return err
+	}
+	if current == "" || !etagMatches(header, quoteETag(current), false) {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+//ApiCacheSize is a maximum number of results which are cached by all endpoints,
+//the least recently used results are evicted first
+var ApiCacheSize = 1024
+
+//apiCache keeps results of endpoints with 'cache' option
+var apiCache = &resultCache{entries: map[string]*list.Element{}, order: list.New(), now: time.Now}
+
+//PurgeApiCache evicts every cached result
+func PurgeApiCache() {
+	apiCache.deletePrefix("")
+}
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+//resultCache is a concurrency-safe LRU cache of results of API methods
+type resultCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	//now is a clock results expire by, tests can move it forward instead of waiting
+	now func() time.Time
+}
+
+//newCacheKey returns a key of a result of a receiver by an endpoint and values of parameters,
+//a key of some first values is a prefix of keys of all values
+func newCacheKey(receiver interface{}, url string, values ...interface{}) string {
+	key := fmt.Sprintf("%p %q", receiver, url)
+	for _, v := range values {
+		key += " " + strconv.Quote(fmt.Sprint(v))
+	}
+	return key
+}
+
+//cacheableRequest reports whether results of a request can be cached
+func cacheableRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+//lookup returns a result which isn't expired, only GET and HEAD requests are served from the cache
+func (c *resultCache) lookup(r *http.Request, key string) (interface{}, bool) {
+	if !cacheableRequest(r) {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if c.now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+//store caches a result of GET and HEAD requests
+func (c *resultCache) store(r *http.Request, key string, value interface{}, ttl time.Duration) {
+	if !cacheableRequest(r) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &cacheEntry{key: key, value: value, expires: c.now().Add(ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > ApiCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+//deletePrefix evicts results whose keys start with a prefix
+func (c *resultCache) deletePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, elem := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.order.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+}
+
+//StoredResponse is a response of a request with 'Idempotency-Key' header,
+//zero Status means the request is in progress
+type StoredResponse struct {
+	Fingerprint string
+	Status      int
+	Header      http.Header
+	Body        []byte
+}
+
+//IdempotencyStore keeps responses of idempotent endpoints by keys of requests
+type IdempotencyStore interface {
+	//Reserve stores a response in progress unless a key is stored already, false means it is
+	Reserve(key string, resp *StoredResponse, ttl time.Duration) bool
+	Load(key string) (*StoredResponse, bool)
+	Save(key string, resp *StoredResponse, ttl time.Duration)
+	Delete(key string)
+}
+
+//ApiIdempotencyStore keeps responses of idempotent endpoints for IdempotencyTTL,
+//it can be replaced by a store which is shared by instances of a service
+var (
+	ApiIdempotencyStore IdempotencyStore = NewMemoryIdempotencyStore()
+	IdempotencyTTL                       = 24 * time.Hour
+)
+
+//MemoryIdempotencyStore is an in-process IdempotencyStore
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]memoryIdempotencyEntry
+	lastPurge time.Time
+}
+
+type memoryIdempotencyEntry struct {
+	resp    *StoredResponse
+	expires time.Time
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{entries: map[string]memoryIdempotencyEntry{}}
+}
+
+func (s *MemoryIdempotencyStore) Reserve(key string, resp *StoredResponse, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastPurge) > time.Minute {
+		for k, entry := range s.entries {
+			if now.After(entry.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastPurge = now
+	}
+	if entry, ok := s.entries[key]; ok && now.Before(entry.expires) {
+		return false
+	}
+	s.entries[key] = memoryIdempotencyEntry{resp: resp, expires: now.Add(ttl)}
+	return true
+}
+
+func (s *MemoryIdempotencyStore) Load(key string) (*StoredResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.resp, true
+}
+
+func (s *MemoryIdempotencyStore) Save(key string, resp *StoredResponse, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = memoryIdempotencyEntry{resp: resp, expires: time.Now().Add(ttl)}
+}
+
+func (s *MemoryIdempotencyStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+//responseRecorder copies a response which is written to a client
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	//uncompressed is a body before compression, it's compressed again when it's replayed
+	uncompressed []byte
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(data)
+	return rec.ResponseWriter.Write(data)
+}
+
+//serveIdempotent replays a stored response of a request with 'Idempotency-Key' header
+//or returns a writer recording the response and a function storing it, nil function means the request is served.
+//Keys are used with the same payload only, server errors aren't stored so requests can be retried.
+//Keys of different receivers, endpoints and 'X-Auth' identities don't clash
+func serveIdempotent(w http.ResponseWriter, r *http.Request, errs errorWriter, receiver interface{}) (http.ResponseWriter, func()) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return w, func() {}
+	}
+	scope := sha256.Sum256([]byte(fmt.Sprintf("%p %q %q %q", receiver, r.Header.Get("X-Auth"), r.URL.Path, key)))
+	key = hex.EncodeToString(scope[:])
+	if !parseForm(w, r, errs) {
+		return nil, nil
+	}
+	sum := sha256.Sum256([]byte(r.Form.Encode()))
+	fingerprint := hex.EncodeToString(sum[:])
+
+	if !ApiIdempotencyStore.Reserve(key, &StoredResponse{Fingerprint: fingerprint}, IdempotencyTTL) {
+		stored, ok := ApiIdempotencyStore.Load(key)
+		switch {
+		case !ok || stored.Status == 0:
+			errs.writeError(w, r, errIdempotencyInProgress, nil)
+		case stored.Fingerprint != fingerprint:
+			errs.writeError(w, r, errIdempotencyMismatch, nil)
+		default:
+			for name, values := range stored.Header {
+				w.Header()[name] = values
+			}
+			body := stored.Body
+			for _, vary := range stored.Header.Values("Vary") {
+				if strings.EqualFold(vary, "Accept-Encoding") {
+					body = compressAnswer(w, r, body)
+				}
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			_, _ = w.Write(body)
+		}
+		return nil, nil
+	}
+
+	rec := &responseRecorder{ResponseWriter: w}
+	return rec, func() {
+		if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+			ApiIdempotencyStore.Delete(key)
+			return
+		}
+		stored := &StoredResponse{
+			Fingerprint: fingerprint,
+			Status:      rec.status,
+			Header:      w.Header().Clone(),
+			Body:        rec.body.Bytes(),
+		}
+		if rec.uncompressed != nil {
+			stored.Header.Del("Content-Encoding")
+			stored.Body = rec.uncompressed
+		}
+		ApiIdempotencyStore.Save(key, stored, IdempotencyTTL)
+	}
+}
+
+//parseForm parses parameters of a request, a body which is too large gets 413 and a malformed one gets 400
+func parseForm(w http.ResponseWriter, r *http.Request, errs errorWriter) bool {
+	err := r.ParseForm()
+	if err == nil {
+		return true
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		errs.writeError(w, r, errBodyTooLarge, nil)
+		return false
+	}
+	errs.writeError(w, r, ApiError{HTTPStatus: http.StatusBadRequest, Err: err, Code: "bad_request"}, nil)
+	return false
+}
+
+//timeoutKey marks contexts of requests of endpoints with 'timeout' option
+type timeoutKey struct{}
+
+//requestWithTimeout returns a request whose context is done after a timeout,
+//API methods get the context and its deadline is reported as 504
+func requestWithTimeout(r *http.Request, timeout time.Duration) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return r.WithContext(context.WithValue(ctx, timeoutKey{}, true)), cancel
+}
+
+//timedOut reports whether a context of a request is done by 'timeout' option of its endpoint,
+//other deadlines, e.g. of calls made by API methods, aren't timeouts of requests
+func timedOut(ctx context.Context) bool {
+	return ctx.Value(timeoutKey{}) != nil && errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
+
+//CompressMinSize is a size of the smallest response which is compressed
+var CompressMinSize = 1024
+
+//compressAnswer compresses data by the first encoding of 'Accept-Encoding' header which is supported,
+//the data is kept as is if it's small or no encoding is acceptable
+func compressAnswer(w http.ResponseWriter, r *http.Request, data []byte) []byte {
+	if len(data) < CompressMinSize {
+		return data
+	}
+	encodings, _ := acceptedValues(r.Header.Get("Accept-Encoding"))
+	for _, encoding := range encodings {
+		var buf bytes.Buffer
+		var cw io.WriteCloser
+		switch encoding {
+		case "gzip":
+			cw = gzip.NewWriter(&buf)
+		case "deflate":
+			//"deflate" content coding is deflate data in zlib format
+			cw = zlib.NewWriter(&buf)
+		default:
+			continue
+		}
+		if _, err := cw.Write(data); err != nil || cw.Close() != nil {
+			return data
+		}
+		w.Header().Set("Content-Encoding", encoding)
+		return buf.Bytes()
+	}
+	return data
+}
+
+//acceptedValues returns values of an 'Accept'-like header ordered by their quality
+//and values refused by zero quality separately
+func acceptedValues(header string) ([]string, []string) {
+	values, refused := weightedValues(header)
+	res := make([]string, 0, len(values))
+	for _, v := range values {
+		res = append(res, v.value)
+	}
+	return res, refused
+}
+
+//valueQ is a value of an 'Accept'-like header with its quality
+type valueQ struct {
+	value string
+	q     float64
+}
+
+//weightedValues works like acceptedValues keeping qualities of accepted values
+func weightedValues(header string) ([]valueQ, []string) {
+	var values []valueQ
+	var refused []string
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		value := strings.ToLower(strings.TrimSpace(params[0]))
+		if value == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			values = append(values, valueQ{value: value, q: q})
+		} else {
+			refused = append(refused, value)
+		}
+	}
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].q > values[j].q
+	})
+	return values, refused
+}
+
+//setContentType sets a type of a response and forbids clients to sniff another one
+func setContentType(w http.ResponseWriter, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+}
+
+//ErrorMapper can be implemented by a receiver to convert errors returned by its methods,
+//e.g. to map sql.ErrNoRows to ApiError with http.StatusNotFound.
+//Returning nil keeps the original error
+type ErrorMapper interface {
+	MapError(err error) error
+}
+
+//ApiProductionMode hides texts of unknown errors of API methods behind a generic message
+var ApiProductionMode = false
+
+//serveMethodError reports an error returned by an API method
+func serveMethodError(w http.ResponseWriter, r *http.Request, errs errorWriter, receiver interface{}, err error) {
+	errs.writeError(w, r, methodApiError(r.Context(), receiver, err), nil)
+}
+
+//methodApiError converts an error returned by an API method of a request with a context,
+//ApiError (a value or a pointer, wrapped or not) keeps its status, the timeout of the request is 504
+//and others become 500
+func methodApiError(ctx context.Context, receiver interface{}, err error) ApiError {
+	if mapper, ok := receiver.(ErrorMapper); ok {
+		if mapped := mapper.MapError(err); mapped != nil {
+			err = mapped
+		}
+	}
+	if ae, ok := asApiError(err); ok {
+		return ae
+	}
+	if errors.Is(err, context.DeadlineExceeded) && timedOut(ctx) {
+		return errTimeout
+	}
+	if ApiProductionMode {
+		return errInternal
+	}
+	return ApiError{HTTPStatus: http.StatusInternalServerError, Err: err, Code: errInternal.Code}
+}
+
+//serveValidateError reports an error returned by 'Validate' method of parameters,
+//ApiError keeps its status, others become 400
+func serveValidateError(w http.ResponseWriter, r *http.Request, errs errorWriter, err error) {
+	if ae, ok := asApiError(err); ok {
+		errs.writeError(w, r, ae, nil)
+		return
+	}
+	errs.writeError(w, r, ApiError{HTTPStatus: http.StatusBadRequest, Err: err, Code: "invalid"}, nil)
+}
+
+//asApiError finds ApiError (a value or a pointer) in a chain of wrapped errors
+func asApiError(err error) (ApiError, bool) {
+	var ae ApiError
+	if errors.As(err, &ae) {
+		return ae, true
+	}
+	var pae *ApiError
+	if errors.As(err, &pae) && pae != nil {
+		return *pae, true
+	}
+	return ApiError{}, false
+}
+
+//FieldError describes a failed check of a parameter in the "all" errors mode
+type FieldError struct {
+	Param   string ` + "`json:\"param\"`" + `
+	Code    string ` + "`json:\"code\"`" + `
+	Message string ` + "`json:\"message\"`" + `
+}
+
+//hasFieldError reports whether any of parameters has failed a check
+func hasFieldError(fieldErrors []FieldError, params ...string) bool {
+	for _, fe := range fieldErrors {
+		for _, param := range params {
+			if fe.Param == param {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func serveFieldErrors(w http.ResponseWriter, r *http.Request, errs errorWriter, fieldErrors []FieldError) {
+	messages := make([]string, 0, len(fieldErrors))
+	for _, fe := range fieldErrors {
+		messages = append(messages, fe.Message)
+	}
+	ae := ApiError{
+		HTTPStatus: http.StatusBadRequest,
+		Err:        errors.New(strings.Join(messages, "; ")),
+		Code:       "invalid_params",
+	}
+	errs.writeError(w, r, ae, fieldErrors)
+}
+
+//errorWriter writes errors in a format of an envelope of an endpoint
+type errorWriter interface {
+	writeError(w http.ResponseWriter, r *http.Request, ae ApiError, fields []FieldError)
+}
+
+//legacyErrors writes errors like {"error": "...", "code": "..."}
+type legacyErrors struct{}
+
+func (legacyErrors) writeError(w http.ResponseWriter, r *http.Request, ae ApiError, fields []FieldError) {
+	writeErrorData(w, ae.HTTPStatus, contentTypeJSON, ae.prepAnswer(fields))
+}
+
+//ProblemTypeBase is a prefix of 'type' URIs of problem details of errors having a code,
+//'type' is "about:blank" if it's empty
+var ProblemTypeBase = ""
+
+//problemDetails is a body of RFC 7807 'application/problem+json' response
+//with 'code' and 'invalid-params' extensions
+type problemDetails struct {
+	Type          string          ` + "`json:\"type\"`" + `
+	Title         string          ` + "`json:\"title\"`" + `
+	Status        int             ` + "`json:\"status\"`" + `
+	Detail        string          ` + "`json:\"detail,omitempty\"`" + `
+	Instance      string          ` + "`json:\"instance,omitempty\"`" + `
+	Code          string          ` + "`json:\"code,omitempty\"`" + `
+	InvalidParams []invalidParam  ` + "`json:\"invalid-params,omitempty\"`" + `
+}
+
+//invalidParam describes a failed check of a parameter in problem details
+type invalidParam struct {
+	Name   string ` + "`json:\"name\"`" + `
+	Code   string ` + "`json:\"code,omitempty\"`" + `
+	Reason string ` + "`json:\"reason\"`" + `
+}
+
+//problemErrors writes errors as RFC 7807 problem details
+type problemErrors struct{}
+
+func (problemErrors) writeError(w http.ResponseWriter, r *http.Request, ae ApiError, fields []FieldError) {
+	problem := problemDetails{
+		Type:   "about:blank",
+		Title:  http.StatusText(ae.HTTPStatus),
+		Status: ae.HTTPStatus,
+		Detail: ae.Error(),
+		Code:   ae.Code,
+	}
+	if ProblemTypeBase != "" && ae.Code != "" {
+		problem.Type = ProblemTypeBase + ae.Code
+	}
+	if r != nil {
+		problem.Instance = r.URL.Path
+	}
+	for _, fe := range fields {
+		problem.InvalidParams = append(problem.InvalidParams, invalidParam{Name: fe.Param, Code: fe.Code, Reason: fe.Message})
+	}
+	if param, ok := ae.Details["param"].(string); ok && len(fields) == 0 {
+		problem.InvalidParams = []invalidParam{{Name: param, Code: ae.Code, Reason: ae.Error()}}
+	}
+	data, _ := json.Marshal(problem)
+	writeErrorData(w, ae.HTTPStatus, "application/problem+json", data)
+}
+
+//ResponseWrapper is implemented by a custom envelope of responses,
+//it's named by 'wrapper' option of 'apigen:api' and created by new() for every response
+type ResponseWrapper interface {
+	WrapResponse(response interface{}) interface{}
+	WrapError(ae ApiError, fields []FieldError) interface{}
+}
+
+//wrappedErrors writes errors wrapped by a custom envelope
+type wrappedErrors struct {
+	wrapper ResponseWrapper
+}
+
+func (we wrappedErrors) writeError(w http.ResponseWriter, r *http.Request, ae ApiError, fields []FieldError) {
+	data, err := json.Marshal(we.wrapper.WrapError(ae, fields))
+	if err != nil {
+		legacyErrors{}.writeError(w, r, ae, fields)
+		return
+	}
+	writeErrorData(w, ae.HTTPStatus, contentTypeJSON, data)
+}
+
+//writeErrorData writes an encoded error
+func writeErrorData(w http.ResponseWriter, status int, contentType string, data []byte) {
+	setContentType(w, contentType)
+	w.WriteHeader(status)
+	_, err := w.Write(data)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+}
+//Page is a requested page of a paginated method, Offset is set by "offset" pagination
+//and Cursor is set by "cursor" one
+type Page struct {
+	Limit  int
+	Offset int
+	Cursor string
+	mode   string
+}
+
+//PageDefaultLimit is used if "limit" parameter isn't set, greater limits are cut to PageMaxLimit
+var (
+	PageDefaultLimit = 20
+	PageMaxLimit     = 100
+)
+
+//NextCursorer is implemented by results of methods with "cursor" pagination,
+//an empty cursor means the last page
+type NextCursorer interface {
+	NextCursor() string
+}
+
+//HasMorer can be implemented by results of methods with "offset" pagination,
+//otherwise a page is considered the last one if it has less than 'Limit' elements
+type HasMorer interface {
+	HasMore() bool
+}
+
+//bindPage binds "limit" and "offset" or "cursor" parameters of a paginated method
+func bindPage(r *http.Request, mode string) (Page, error) {
+	page := Page{Limit: PageDefaultLimit, Cursor: r.Form.Get("cursor"), mode: mode}
+	var err error
+	if raw := r.Form.Get("limit"); raw != "" {
+		if page.Limit, err = strconv.Atoi(raw); err != nil {
+			return page, newParamError("limit", "type", localize(r, "type_int", map[string]string{"param": "limit"}))
+		}
+		if page.Limit < 1 {
+			return page, newParamError("limit", "min", localize(r, "min", map[string]string{"param": "limit", "min": "1"}))
+		}
+	}
+	if page.Limit > PageMaxLimit {
+		page.Limit = PageMaxLimit
+	}
+	if mode != "offset" {
+		return page, nil
+	}
+	page.Cursor = ""
+	if raw := r.Form.Get("offset"); raw != "" {
+		if page.Offset, err = strconv.Atoi(raw); err != nil {
+			return page, newParamError("offset", "type", localize(r, "type_int", map[string]string{"param": "offset"}))
+		}
+		if page.Offset < 0 {
+			return page, newParamError("offset", "min", localize(r, "min", map[string]string{"param": "offset", "min": "0"}))
+		}
+	}
+	return page, nil
+}
+
+//serveNextPageLink sets 'Link' header to the next page of a result if there is one
+//and returns a cursor of the next page for "cursor" pagination
+func serveNextPageLink(w http.ResponseWriter, r *http.Request, page Page, result interface{}) string {
+	query := r.URL.Query()
+	query.Set("limit", strconv.Itoa(page.Limit))
+	nextCursor := ""
+	if page.mode == "cursor" {
+		if c, ok := result.(NextCursorer); ok {
+			nextCursor = c.NextCursor()
+		}
+		if nextCursor == "" {
+			return ""
+		}
+		query.Set("cursor", nextCursor)
+	} else {
+		if !hasMore(page, result) {
+			return ""
+		}
+		query.Set("offset", strconv.Itoa(page.Offset+page.Limit))
+	}
+	w.Header().Add("Link", "<"+r.URL.Path+"?"+query.Encode()+">; rel=\"next\"")
+	return nextCursor
+}
+
+//hasMore reports whether there is a page after a result of "offset" pagination
+func hasMore(page Page, result interface{}) bool {
+	if m, ok := result.(HasMorer); ok {
+		return m.HasMore()
+	}
+	rv := reflect.ValueOf(result)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return rv.Len() >= page.Limit
+	}
+	return false
+}
+
+/*
+The end of "Auxiliary functions" section
+*/
+`
+	_, _ = buf.WriteString("\n" + errSection + "\n\n")
+}
+
+//generateEncodersSection appends to *bytes.Buffer encoders of responses
+//and their negotiation by 'Accept' header
+func generateEncodersSection(buf *bytes.Buffer) {
+	fmt.Println("Generating encoders")
+	section := `/*
+"Encoders" section
+Beginning of "Encoders" section
+*/
+
+//Encoder encodes responses in a media type
+type Encoder interface {
+	//MediaType is matched against 'Accept' header, e.g. "application/json"
+	MediaType() string
+	//ContentType is sent in 'Content-Type' header
+	ContentType() string
+	//Encode returns errNotEncodable for values the encoder doesn't support
+	Encode(v interface{}) ([]byte, error)
+}
+
+//encoders are tried in order of registration at equal quality,
+//the first one is JSON which is used if a request has no 'Accept' header
+var encoders = []Encoder{jsonEncoder{}, xmlEncoder{}, msgpackEncoder{}, csvEncoder{}}
+
+//RegisterEncoder adds an encoder or replaces a registered one of the same media type
+func RegisterEncoder(e Encoder) {
+	for i, known := range encoders {
+		if known.MediaType() == e.MediaType() {
+			encoders[i] = e
+			return
+		}
+	}
+	encoders = append(encoders, e)
+}
+
+var errNotEncodable = errors.New("value can't be encoded")
+
+//payloader is implemented by envelopes which wrap a result of a method
+type payloader interface {
+	payload() interface{}
+}
+
+//negotiateEncoder returns the most preferred encoder which is acceptable for a request and can encode a value
+//with encoded data, nil is returned if there is no such encoder.
+//Encoders are preferred by the quality of the most specific media range matching them,
+//JSON wins ties and is kept if a client accepts it through a wildcard only,
+//so other formats are sent to clients which name them over JSON, not to browsers listing "application/xml"
+func negotiateEncoder(r *http.Request, v interface{}) (Encoder, []byte) {
+	header := r.Header.Get("Accept")
+	accepted, refused := weightedValues(header)
+	if strings.TrimSpace(header) == "" {
+		accepted = []valueQ{{value: "*/*", q: 1}}
+	}
+	type candidate struct {
+		encoder Encoder
+		q       float64
+	}
+	var candidates []candidate
+	for i, e := range encoders {
+		q, specificity := mediaTypeQuality(accepted, refused, e.MediaType())
+		if q == 0 {
+			continue
+		}
+		if i == 0 && specificity < 2 {
+			q = math.Inf(1)
+		}
+		candidates = append(candidates, candidate{encoder: e, q: q})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+	for _, c := range candidates {
+		if data, err := c.encoder.Encode(v); err == nil {
+			return c.encoder, data
+		}
+	}
+	return nil, nil
+}
+
+//mediaTypeQuality returns the quality of a media type given by the most specific media range matching it
+//and the specificity of the range, zero quality means the media type isn't acceptable
+func mediaTypeQuality(accepted []valueQ, refused []string, mediaType string) (float64, int) {
+	q, specificity := 0.0, -1
+	for _, mediaRange := range accepted {
+		s := mediaRangeSpecificity(mediaRange.value)
+		if mediaTypeMatches(mediaRange.value, mediaType) && (s > specificity || s == specificity && mediaRange.q > q) {
+			q, specificity = mediaRange.q, s
+		}
+	}
+	for _, refusedRange := range refused {
+		if mediaTypeMatches(refusedRange, mediaType) && mediaRangeSpecificity(refusedRange) >= specificity {
+			return 0, specificity
+		}
+	}
+	return q, specificity
+}
+
+//acceptsMediaType reports whether 'Accept' header of a request allows a media type
+func acceptsMediaType(r *http.Request, mediaType string) bool {
+	header := r.Header.Get("Accept")
+	if strings.TrimSpace(header) == "" {
+		return true
+	}
+	accepted, refused := weightedValues(header)
+	q, _ := mediaTypeQuality(accepted, refused, mediaType)
+	return q > 0
+}
+
+//mediaRangeSpecificity orders media ranges: "*/*" < "text/*" < "text/csv"
+func mediaRangeSpecificity(mediaRange string) int {
+	switch {
+	case mediaRange == "*/*":
+		return 0
+	case strings.HasSuffix(mediaRange, "/*"):
+		return 1
+	}
+	return 2
+}
+
+//mediaTypeMatches reports whether a media type is in a media range like "*/*", "text/*" or "text/csv"
+func mediaTypeMatches(mediaRange, mediaType string) bool {
+	if mediaRange == "*/*" || mediaRange == mediaType {
+		return true
+	}
+	prefix, ok := strings.CutSuffix(mediaRange, "/*")
+	return ok && strings.HasPrefix(mediaType, prefix+"/")
+}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) MediaType() string   { return "application/json" }
+func (jsonEncoder) ContentType() string { return contentTypeJSON }
+func (jsonEncoder) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+type xmlEncoder struct{}
+
+func (xmlEncoder) MediaType() string   { return "application/xml" }
+func (xmlEncoder) ContentType() string { return "application/xml; charset=utf-8" }
+func (xmlEncoder) Encode(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		rv = rv.Elem()
+	}
+	//slices and maps have no root element
+	if !rv.IsValid() || rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array || rv.Kind() == reflect.Map {
+		return nil, errNotEncodable
+	}
+	root := rv.Type().Name()
+	if !xmlName(root) {
+		root = "response"
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	buf := bytes.NewBufferString(xml.Header)
+	if err = appendXMLElement(buf, dec, root, false); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//appendXMLElement appends the next JSON value of a decoder as an element, so elements are named
+//by json tags like keys in JSON: members of objects become child elements,
+//elements of arrays are repeated elements and nulls are omitted
+func appendXMLElement(buf *bytes.Buffer, dec *json.Decoder, name string, inArray bool) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok := tok.(type) {
+	case nil:
+		return nil
+	case json.Delim:
+		if tok == '[' {
+			if inArray {
+				return errNotEncodable
+			}
+			for dec.More() {
+				if err = appendXMLElement(buf, dec, name, true); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+		}
+		buf.WriteString("<" + name + ">")
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			if !xmlName(key.(string)) {
+				return errNotEncodable
+			}
+			if err = appendXMLElement(buf, dec, key.(string), false); err != nil {
+				return err
+			}
+		}
+		if _, err = dec.Token(); err != nil {
+			return err
+		}
+	default:
+		buf.WriteString("<" + name + ">")
+		if err = xml.EscapeText(buf, []byte(fmt.Sprint(tok))); err != nil {
+			return err
+		}
+	}
+	buf.WriteString("</" + name + ">")
+	return nil
+}
+
+//xmlName reports whether a string can be a name of an element
+func xmlName(name string) bool {
+	for i, c := range name {
+		if !unicode.IsLetter(c) && c != '_' && (i == 0 || !unicode.IsDigit(c) && c != '-' && c != '.') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+//msgpackEncoder encodes a value in MessagePack format the same way as it's encoded in JSON
+type msgpackEncoder struct{}
+
+func (msgpackEncoder) MediaType() string   { return "application/msgpack" }
+func (msgpackEncoder) ContentType() string { return "application/msgpack" }
+func (msgpackEncoder) Encode(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var generic interface{}
+	if err = dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return appendMsgpack(nil, generic), nil
+}
+
+//appendMsgpack appends a value decoded from JSON in MessagePack format, keys of maps are sorted
+func appendMsgpack(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			if i >= 0 && i < 128 {
+				return append(b, byte(i))
+			}
+			return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(i))
+		}
+		f, _ := v.Float64()
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f))
+	case string:
+		b = appendMsgpackHeader(b, len(v), 0xa0, 31, [3]byte{0xd9, 0xda, 0xdb})
+		return append(b, v...)
+	case []interface{}:
+		b = appendMsgpackHeader(b, len(v), 0x90, 15, [3]byte{0, 0xdc, 0xdd})
+		for _, item := range v {
+			b = appendMsgpack(b, item)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = appendMsgpackHeader(b, len(v), 0x80, 15, [3]byte{0, 0xde, 0xdf})
+		for _, k := range keys {
+			b = appendMsgpack(b, k)
+			b = appendMsgpack(b, v[k])
+		}
+		return b
+	}
+	return append(b, 0xc0)
+}
+
+//appendMsgpackHeader appends a header of a string, an array or a map of n elements,
+//codes are 8, 16 and 32 bit forms, zero code means there is no such form
+func appendMsgpackHeader(b []byte, n int, fix byte, fixMax int, codes [3]byte) []byte {
+	switch {
+	case n <= fixMax:
+		return append(b, fix|byte(n))
+	case codes[0] != 0 && n <= math.MaxUint8:
+		return append(b, codes[0], byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, codes[1]), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, codes[2]), uint32(n))
+}
+
+//csvEncoder encodes slices only, a row per element,
+//columns of structures are named by their json tags
+type csvEncoder struct{}
+
+func (csvEncoder) MediaType() string   { return "text/csv" }
+func (csvEncoder) ContentType() string { return "text/csv; charset=utf-8" }
+func (csvEncoder) Encode(v interface{}) ([]byte, error) {
+	if p, ok := v.(payloader); ok {
+		v = p.payload()
+	}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, errNotEncodable
+	}
+	elemType := rv.Type().Elem()
+	for elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	header, fields := []string{"value"}, [][]int(nil)
+	if elemType.Kind() == reflect.Struct {
+		header, fields = csvColumns(elemType)
+	}
+	_ = cw.Write(header)
+	for i := 0; i < rv.Len(); i++ {
+		elem := rv.Index(i)
+		for elem.Kind() == reflect.Ptr && !elem.IsNil() {
+			elem = elem.Elem()
+		}
+		row := make([]string, len(header))
+		switch {
+		case elem.Kind() == reflect.Ptr:
+		case fields == nil:
+			row[0] = fmt.Sprint(elem.Interface())
+		default:
+			for j, field := range fields {
+				//fields of a nil embedded pointer are empty
+				if value, err := elem.FieldByIndexErr(field); err == nil {
+					row[j] = fmt.Sprint(value.Interface())
+				}
+			}
+		}
+		_ = cw.Write(row)
+	}
+	cw.Flush()
+	return buf.Bytes(), cw.Error()
+}
+
+//csvColumns returns names of columns and index paths of exported fields of a structure,
+//fields of embedded structures are columns of their own like they're members of JSON objects
+func csvColumns(t reflect.Type) ([]string, [][]int) {
+	var names []string
+	var fields [][]int
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := ""
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			name, _, _ = strings.Cut(tag, ",")
+			if name == "-" {
+				continue
+			}
+		}
+		embedded := f.Type
+		if embedded.Kind() == reflect.Ptr {
+			embedded = embedded.Elem()
+		}
+		if f.Anonymous && name == "" && embedded.Kind() == reflect.Struct {
+			embeddedNames, embeddedFields := csvColumns(embedded)
+			names = append(names, embeddedNames...)
+			for _, field := range embeddedFields {
+				fields = append(fields, append([]int{i}, field...))
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		names = append(names, name)
+		fields = append(fields, []int{i})
+	}
+	return names, fields
+}
+
+/*
+The end of "Encoders" section
+*/
+`
+	_, _ = buf.WriteString("\n" + section + "\n\n")
+}
+
+//generateStreamsSection appends to *bytes.Buffer writers of streamed results
+func generateStreamsSection(buf *bytes.Buffer) {
+	fmt.Println("Generating streams")
+	section := `/*
+"Streams" section
+Beginning of "Streams" section
+*/
+
+//contentTypeNDJSON is a type of streamed results, a JSON value per line
+const contentTypeNDJSON = "application/x-ndjson"
+
+//ErrStreamClosed is returned by send functions of streamed methods when a client has gone
+var ErrStreamClosed = errors.New("stream is closed")
+
+//ndjsonStream writes elements of a streamed result as newline-delimited JSON,
+//every line is flushed to a client at once
+type ndjsonStream struct {
+	ctx     context.Context
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+//newNDJSONStream sends headers of a stream, its status is always 200,
+//so errors which happen later are reported by the last line
+func newNDJSONStream(w http.ResponseWriter, r *http.Request) *ndjsonStream {
+	setContentType(w, contentTypeNDJSON)
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	s := &ndjsonStream{ctx: r.Context(), w: w, flusher: flusher}
+	s.flush()
+	return s
+}
+
+//write writes an element, false means the stream must be stopped
+func (s *ndjsonStream) write(v interface{}) bool {
+	data, err := json.Marshal(v)
+	if err != nil {
+		s.fail(nil, err)
+		return false
+	}
+	return s.writeLine(data)
+}
+
+//fail writes an error as the last line,
+//errors of a receiver are converted like errors of non-streamed methods
+func (s *ndjsonStream) fail(receiver interface{}, err error) {
+	s.writeLine(methodApiError(s.ctx, receiver, err).prepAnswer(nil))
+}
+
+func (s *ndjsonStream) writeLine(data []byte) bool {
+	if _, err := s.w.Write(append(data, '\n')); err != nil {
+		return false
+	}
+	s.flush()
+	return true
+}
+
+func (s *ndjsonStream) flush() {
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+//contentTypeEventStream is a type of Server-Sent Events streams
+const contentTypeEventStream = "text/event-stream"
+
+//SSEHeartbeat is an interval of comments which keep idle event streams alive
+var SSEHeartbeat = 15 * time.Second
+
+//ServerEvent is an event of a Server-Sent Events stream with a name and an id,
+//other values are sent as data of unnamed events without ids.
+//Data is encoded in JSON
+type ServerEvent struct {
+	ID    string
+	Event string
+	Data  interface{}
+}
+
+//sseFieldReplacer keeps an id and a name of an event in a single line
+var sseFieldReplacer = strings.NewReplacer("\r", "", "\n", "")
+
+//bindLastEventID passes 'Last-Event-ID' header of a reconnected event stream
+//as "last_event_id" parameter unless it's set explicitly
+func bindLastEventID(r *http.Request) {
+	if id := r.Header.Get("Last-Event-ID"); id != "" && r.Form.Get("last_event_id") == "" {
+		r.Form.Set("last_event_id", id)
+	}
+}
+
+//sseStream writes events of Server-Sent Events stream and heartbeats between them
+type sseStream struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	w       http.ResponseWriter
+	flusher http.Flusher
+	closed  bool
+	done    chan struct{}
+}
+
+//newSSEStream sends headers of a stream and starts heartbeats which are stopped
+//by the end of a request context or by stop
+func newSSEStream(w http.ResponseWriter, r *http.Request) *sseStream {
+	setContentType(w, contentTypeEventStream)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	s := &sseStream{ctx: r.Context(), w: w, flusher: flusher, done: make(chan struct{})}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	go s.heartbeat(r.Context().Done())
+	return s
+}
+
+func (s *sseStream) heartbeat(ctxDone <-chan struct{}) {
+	ticker := time.NewTicker(SSEHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctxDone:
+			return
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if !s.writeFrame(": heartbeat\n\n") {
+				return
+			}
+		}
+	}
+}
+
+//stop stops heartbeats, nothing is written after it
+func (s *sseStream) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+}
+
+//write writes an event, false means the stream must be stopped
+func (s *sseStream) write(v interface{}) bool {
+	ev, ok := v.(ServerEvent)
+	if p, isPtr := v.(*ServerEvent); isPtr && p != nil {
+		ev, ok = *p, true
+	}
+	if !ok {
+		ev = ServerEvent{Data: v}
+	}
+	data, err := json.Marshal(ev.Data)
+	if err != nil {
+		s.fail(nil, err)
+		return false
+	}
+	frame := ""
+	if ev.ID != "" {
+		frame += "id: " + sseFieldReplacer.Replace(ev.ID) + "\n"
+	}
+	if ev.Event != "" {
+		frame += "event: " + sseFieldReplacer.Replace(ev.Event) + "\n"
+	}
+	return s.writeFrame(frame + "data: " + string(data) + "\n\n")
+}
+
+//fail sends an error as the last event named "error",
+//errors of a receiver are converted like errors of non-streamed methods
+func (s *sseStream) fail(receiver interface{}, err error) {
+	data := methodApiError(s.ctx, receiver, err).prepAnswer(nil)
+	s.writeFrame("event: error\ndata: " + string(data) + "\n\n")
+}
+
+func (s *sseStream) writeFrame(frame string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if _, err := s.w.Write([]byte(frame)); err != nil {
+		return false
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return true
+}
+
+/*
+The end of "Streams" section
+*/
+`
+	_, _ = buf.WriteString("\n" + section + "\n\n")
+}
+
+//generateMessagesSection appends to *bytes.Buffer default templates of validation messages
+//and their translation by 'Accept-Language' header
+func generateMessagesSection(buf *bytes.Buffer) {
+	fmt.Println("Generating 'Validation Messages' Section")
+	ids := make([]string, 0, len(messageTemplates))
+	for id := range messageTemplates {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	templates := ""
+	for _, id := range ids {
+		templates += strconv.Quote(id) + ": " + strconv.Quote(messageTemplates[id]) + ",\n"
+	}
+
+	msgSection := `/*
+"Validation Messages" section
+Beginning of "Validation Messages" section
+*/
+
+//Translator translates templates of validation messages by their IDs
+type Translator interface {
+	Translate(lang string, id string) (string, bool)
+}
+
+//ApiTranslator is used to translate validation messages,
+//the default english templates are used if it's nil or has no translation
+var ApiTranslator Translator
+
+var defaultMessages = map[string]string{
+` + templates + `}
+
+//CatalogTranslator keeps templates of messages by languages and IDs
+type CatalogTranslator map[string]map[string]string
+
+//Translate finds a template for a language or for its primary subtag ("ru" for "ru-RU")
+func (c CatalogTranslator) Translate(lang string, id string) (string, bool) {
+	lang = strings.ToLower(lang)
+	if tpl, ok := c[lang][id]; ok {
+		return tpl, true
+	}
+	if i := strings.Index(lang, "-"); i > 0 {
+		tpl, ok := c[lang[:i]][id]
+		return tpl, ok
+	}
+	return "", false
+}
+
+//LoadCatalogTranslator reads '<lang>.json' files of a directory,
+//every file is an object of templates by IDs, e.g. {"required": "{param} не должен быть пустым"}
+func LoadCatalogTranslator(dir string) (CatalogTranslator, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	c := make(CatalogTranslator)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		templates := make(map[string]string)
+		if err = json.Unmarshal(data, &templates); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		c[strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".json"))] = templates
+	}
+	return c, nil
+}
+
+//requestLanguages returns languages of 'Accept-Language' header ordered by their quality
+func requestLanguages(r *http.Request) []string {
+	var langs []string
+	accepted, _ := acceptedValues(r.Header.Get("Accept-Language"))
+	for _, lang := range accepted {
+		if lang != "*" {
+			langs = append(langs, lang)
+		}
+	}
+	return langs
+}
+
+//localize resolves a validation message for a request and fills its placeholders
+func localize(r *http.Request, id string, args map[string]string) string {
+	tpl := defaultMessages[id]
+	if ApiTranslator != nil {
+		for _, lang := range requestLanguages(r) {
+			if translated, ok := ApiTranslator.Translate(lang, id); ok {
+				tpl = translated
+				break
+			}
+		}
+	}
+	pairs := make([]string, 0, len(args)*2)
+	for k, v := range args {
+		pairs = append(pairs, "{"+k+"}", v)
+	}
+	return strings.NewReplacer(pairs...).Replace(tpl)
+}
+/*
+The end of "Validation Messages" section
+*/
+`
+	_, _ = buf.WriteString("\n" + msgSection + "\n\n")
+}
+
+//generateApiErrorsSection appends to *bytes.Buffer Hardcoded Well-known Errors Section
+func generateApiErrorsSection(buf *bytes.Buffer) {
+	fmt.Println("Generating 'Hardcoded Well-known Errors' Section")
+	errSection := `/*
+"Hardcoded Well-known Errors" section
+Beginning of "Hardcoded Well-known Errors" section
+*/
+
+var (
+	errUnknown      = ApiError{HTTPStatus: http.StatusNotFound, Err: errors.New("unknown method"), Code: "unknown_method"}
+	errBadMethod    = ApiError{HTTPStatus: http.StatusNotAcceptable, Err: errors.New("bad method"), Code: "bad_method"}
+	errInternal     = ApiError{HTTPStatus: http.StatusInternalServerError, Err: errors.New("internal error"), Code: "internal"}
+	errUnauthorized = ApiError{HTTPStatus: http.StatusForbidden, Err: errors.New("unauthorized"), Code: "unauthorized"}
+	errNotAcceptable = ApiError{HTTPStatus: http.StatusNotAcceptable, Err: errors.New("not acceptable"), Code: "not_acceptable"}
+	errPreconditionFailed = ApiError{HTTPStatus: http.StatusPreconditionFailed, Err: errors.New("precondition failed"), Code: "precondition_failed"}
+	errBodyTooLarge = ApiError{HTTPStatus: http.StatusRequestEntityTooLarge, Err: errors.New("request body is too large"), Code: "body_too_large"}
+	errTimeout = ApiError{HTTPStatus: http.StatusGatewayTimeout, Err: errors.New("timeout"), Code: "timeout"}
+	errIdempotencyMismatch = ApiError{HTTPStatus: http.StatusConflict, Err: errors.New("idempotency key is used with another payload"), Code: "idempotency_mismatch"}
+	errIdempotencyInProgress = ApiError{HTTPStatus: http.StatusConflict, Err: errors.New("request with the idempotency key is in progress"), Code: "idempotency_in_progress"}
+)
+/*
+The end of "Hardcoded Well-known Errors" section
+*/
+`
+	_, _ = buf.WriteString("\n" + errSection + "\n\n")
+}
+
+//formatCode works like 'gofmt' command and formats a text in *bytes.Buffer
+func formatCode(buf *bytes.Buffer) {
+	fmt.Println("Formatting the code")
+	b, err := format.Source(buf.Bytes())
+	if err != nil {
+		fmt.Println("Can't format: ", err.Error())
+		return
+	}
+	buf.Reset()
+	buf.WriteString(string(b))
+}
+
+//generateImportSection appends dependencies to *bytes.Buffer
+func generateImportSection(buf *bytes.Buffer, packageName string, extra []string) {
+	fmt.Println("Generating 'Import' Section")
+	imports := []string{
+		"bytes",
+		"compress/gzip",
+		"compress/zlib",
+		"container/list",
+		"context",
+		"crypto/sha256",
+		"encoding/binary",
+		"encoding/csv",
+		"encoding/hex",
+		"encoding/json",
+		"encoding/xml",
+		"errors",
+		"fmt",
+		"io",
+		"math",
+		"net/http",
+		"os",
+		"path/filepath",
+		"reflect",
+		"sort",
+		"strconv",
+		"strings",
+		"sync",
+		"time",
+		"unicode",
+	}
+	for _, impItem := range extra {
+		found := false
+		for _, known := range imports {
+			found = found || known == impItem
+		}
+		if !found {
+			imports = append(imports, impItem)
+		}
+	}
+	sort.Strings(imports)
+	_, _ = buf.WriteString("package " + packageName + "\n")
+	_, _ = buf.WriteString("import (\n")
+	for _, impItem := range imports {
+		_, _ = buf.WriteString("\"" + impItem + "\"\n")
+	}
+	_, _ = buf.WriteString(")\n\n")
+
+}
+
+//generateApiErrorsSection appends to *bytes.Buffer Hardcoded Well-known Errors Section
+func generateApiErrorsFuncSection(buf *bytes.Buffer) {
+	fmt.Println("Generating 'Functions Of ApiError' Section")
+	_, _ = buf.WriteString("\n")
+	errFuncSection := `
+	/*
+	"Functions Of ApiError" section -
+	there are additional methods for well-known ApiError
+	to eliminate some doubled code
+
+	Beginning of "Functions Of ApiError" section
+	*/
+
+	func NewApiError(text string, httpStatus int) *ApiError {
+		return &ApiError{HTTPStatus: httpStatus, Err: errors.New(text)}
+	}
+
+	//newParamError creates an error of a failed check of a parameter
+	func newParamError(param string, code string, text string) ApiError {
+		return ApiError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        errors.New(text),
+			Code:       code,
+			Details:    map[string]interface{}{"param": param},
+		}
+	}
+
+	//apiErrorAnswer is an envelope of an error
+	type apiErrorAnswer struct {
+		Error   string                 ` + "`json:\"error\"`" + `
+		Code    string                 ` + "`json:\"code,omitempty\"`" + `
+		Details map[string]interface{} ` + "`json:\"details,omitempty\"`" + `
+		Fields  []FieldError           ` + "`json:\"fields,omitempty\"`" + `
 	}
 
 	func (ae ApiError) PrepApiAnswer() []byte {
-		return []byte("{ \"error\":\"" + ae.Error() + "\"}")
+		return ae.prepAnswer(nil)
 	}
 
-	func (ae ApiError) serve(w http.ResponseWriter) {
-		apiData := ae.PrepApiAnswer()
-		w.Header().Set("Content-Type", http.DetectContentType(apiData))
-		w.WriteHeader(ae.HTTPStatus)
-	_, err := w.Write(apiData)
+	//prepAnswer encodes an error with failed checks of parameters of the "all" errors mode
+	func (ae ApiError) prepAnswer(fields []FieldError) []byte {
+		data, err := json.Marshal(apiErrorAnswer{Error: ae.Error(), Code: ae.Code, Details: ae.Details, Fields: fields})
 		if err != nil {
-			fmt.Println(err.Error())
+			data, _ = json.Marshal(apiErrorAnswer{Error: ae.Error(), Code: ae.Code, Fields: fields})
 		}
+		return data
+	}
+
+	func (ae ApiError) serve(w http.ResponseWriter) {
+		legacyErrors{}.writeError(w, nil, ae, nil)
 	}
 /*
 The end of "functions of ApiError" section
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -25,8 +30,19 @@ type Case struct {
 	Path   string
 	Query  string
 	Auth   bool
-	Status int
-	Result interface{}
+	Accept string
+	// Idempotency-Key повторяемого запроса
+	IdempotencyKey string
+	// прочие заголовки запроса
+	Headers map[string]string
+	Status  int
+	// Content-Type ответа, если он не application/json
+	ContentType string
+	Result      interface{}
+	// тело ответа, которое не разбирается как json, если Result не задан
+	Body string
+	// ожидаемые заголовки ответа
+	ResponseHeaders map[string]string
 }
 
 const (
@@ -70,12 +86,30 @@ func TestMyApi(t *testing.T) {
 				},
 			},
 		},
+		Case{ // логин нормализуется перед проверками
+			Path:   ApiUserProfile,
+			Query:  "login=%20RVasily%20",
+			Status: http.StatusOK,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id":        42,
+					"login":     "rvasily",
+					"full_name": "Vasily Romanov",
+					"status":    20,
+				},
+			},
+		},
 		Case{ // сработала валидация - логин не должен быть пустым
 			Path:   ApiUserProfile,
 			Query:  "",
 			Status: http.StatusBadRequest,
 			Result: CR{
 				"error": "login must me not empty",
+				"code":  "required",
+				"details": CR{
+					"param": "login",
+				},
 			},
 		},
 		Case{ // получили ошибку общего назначения - ваш код сам подставил 500
@@ -84,6 +118,7 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusInternalServerError,
 			Result: CR{
 				"error": "bad user",
+				"code":  "internal",
 			},
 		},
 		Case{ // получили специализированную ошибку - ваш код поставил статус 404 оттуда
@@ -94,6 +129,76 @@ func TestMyApi(t *testing.T) {
 				"error": "user not exist",
 			},
 		},
+		Case{ // ответ нельзя отдать ни в одном из допустимых клиентом форматов
+			Path:   ApiUserProfile,
+			Query:  "login=rvasily",
+			Accept: "application/pdf, text/csv;q=0.5",
+			Status: http.StatusNotAcceptable,
+			Result: CR{
+				"error": "not acceptable",
+				"code":  "not_acceptable",
+			},
+		},
+		Case{ // q=0 запрещает формат, а не равносилен отсутствию заголовка
+			Path:   ApiUserProfile,
+			Query:  "login=rvasily",
+			Accept: "application/json;q=0",
+			Status: http.StatusNotAcceptable,
+			Result: CR{
+				"error": "not acceptable",
+				"code":  "not_acceptable",
+			},
+		},
+		Case{ // запрещённый json пропускается и для */*
+			Path:        ApiUserProfile,
+			Query:       "login=rvasily",
+			Accept:      "*/*, application/json;q=0",
+			Status:      http.StatusOK,
+			ContentType: "application/xml; charset=utf-8",
+			Body: `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+				`<RespMyApiProfile><response><id>42</id><login>rvasily</login><full_name>Vasily Romanov</full_name>` +
+				`<status>20</status></response><error></error></RespMyApiProfile>`,
+		},
+		Case{ // браузер явно называет xml, но json доступен через */* - отдаётся json
+			Path:   ApiUserProfile,
+			Query:  "login=rvasily",
+			Accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			Status: http.StatusOK,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id":        42,
+					"login":     "rvasily",
+					"full_name": "Vasily Romanov",
+					"status":    20,
+				},
+			},
+		},
+		Case{ // при равном качестве отдаётся json
+			Path:   ApiUserProfile,
+			Query:  "login=rvasily",
+			Accept: "application/xml, application/json",
+			Status: http.StatusOK,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id":        42,
+					"login":     "rvasily",
+					"full_name": "Vasily Romanov",
+					"status":    20,
+				},
+			},
+		},
+		Case{ // xml, названный выше json
+			Path:        ApiUserProfile,
+			Query:       "login=rvasily",
+			Accept:      "application/json;q=0.5, application/xml",
+			Status:      http.StatusOK,
+			ContentType: "application/xml; charset=utf-8",
+			Body: `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+				`<RespMyApiProfile><response><id>42</id><login>rvasily</login><full_name>Vasily Romanov</full_name>` +
+				`<status>20</status></response><error></error></RespMyApiProfile>`,
+		},
 		// ------
 		Case{ // это должен ответить ваш ServeHTTP - если ему пришло что-то неизвестное (например когда он обрабатывает /user/)
 			Path:   "/user/unknown",
@@ -101,6 +206,7 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusNotFound,
 			Result: CR{
 				"error": "unknown method",
+				"code":  "unknown_method",
 			},
 		},
 		// ------
@@ -140,6 +246,7 @@ func TestMyApi(t *testing.T) {
 			Auth:   true,
 			Result: CR{
 				"error": "bad method",
+				"code":  "bad_method",
 			},
 		},
 		Case{
@@ -150,6 +257,7 @@ func TestMyApi(t *testing.T) {
 			Auth:   false,
 			Result: CR{
 				"error": "unauthorized",
+				"code":  "unauthorized",
 			},
 		},
 		Case{
@@ -170,6 +278,10 @@ func TestMyApi(t *testing.T) {
 			Auth:   true,
 			Result: CR{
 				"error": "login must me not empty",
+				"code":  "required",
+				"details": CR{
+					"param": "login",
+				},
 			},
 		},
 		Case{
@@ -180,6 +292,25 @@ func TestMyApi(t *testing.T) {
 			Auth:   true,
 			Result: CR{
 				"error": "login len must be >= 10",
+				"code":  "min",
+				"details": CR{
+					"param": "login",
+				},
+			},
+		},
+		Case{
+			// длина считается в символах: 5 символов кириллицы - это 10 байт
+			Path:   ApiUserCreate,
+			Method: http.MethodPost,
+			Query:  "login=логин&age=32&status=moderator&full_name=Ivan_Ivanov",
+			Status: http.StatusBadRequest,
+			Auth:   true,
+			Result: CR{
+				"error": "login len must be >= 10",
+				"code":  "min",
+				"details": CR{
+					"param": "login",
+				},
 			},
 		},
 		Case{
@@ -190,6 +321,10 @@ func TestMyApi(t *testing.T) {
 			Auth:   true,
 			Result: CR{
 				"error": "age must be int",
+				"code":  "type",
+				"details": CR{
+					"param": "age",
+				},
 			},
 		},
 		Case{
@@ -200,6 +335,10 @@ func TestMyApi(t *testing.T) {
 			Auth:   true,
 			Result: CR{
 				"error": "age must be >= 0",
+				"code":  "min",
+				"details": CR{
+					"param": "age",
+				},
 			},
 		},
 		Case{
@@ -210,6 +349,10 @@ func TestMyApi(t *testing.T) {
 			Auth:   true,
 			Result: CR{
 				"error": "age must be <= 128",
+				"code":  "max",
+				"details": CR{
+					"param": "age",
+				},
 			},
 		},
 		Case{
@@ -220,6 +363,10 @@ func TestMyApi(t *testing.T) {
 			Auth:   true,
 			Result: CR{
 				"error": "status must be one of [user, moderator, admin]",
+				"code":  "enum",
+				"details": CR{
+					"param": "status",
+				},
 			},
 		},
 		Case{ // status по-умолчанию
@@ -243,6 +390,70 @@ func TestMyApi(t *testing.T) {
 			Auth:   true,
 			Result: CR{
 				"error": "bad user",
+				"code":  "internal",
+			},
+		},
+		Case{ // кавычки в тексте ошибки не ломают json
+			Path:   ApiUserCreate,
+			Method: http.MethodPost,
+			Query:  "login=mr.%22quoted%22&age=32&full_name=Ivan_Ivanov",
+			Status: http.StatusOK,
+			Auth:   true,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id": 45,
+				},
+			},
+		},
+		Case{
+			Path:   ApiUserCreate,
+			Method: http.MethodPost,
+			Query:  "login=mr.%22quoted%22&age=32&full_name=Ivan_Ivanov",
+			Status: http.StatusConflict,
+			Auth:   true,
+			Result: CR{
+				"error": "user mr.\"quoted\" exist",
+			},
+		},
+		Case{ // создаём юзера с ключом идемпотентности
+			Path:           ApiUserCreate,
+			Method:         http.MethodPost,
+			Query:          "login=mr.retrying&age=32&full_name=Ivan_Ivanov",
+			IdempotencyKey: "retry-1",
+			Status:         http.StatusOK,
+			Auth:           true,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id": 46,
+				},
+			},
+		},
+		Case{ // повтор запроса с тем же ключом получает тот же ответ, а не ошибку "exist"
+			Path:           ApiUserCreate,
+			Method:         http.MethodPost,
+			Query:          "login=mr.retrying&age=32&full_name=Ivan_Ivanov",
+			IdempotencyKey: "retry-1",
+			Status:         http.StatusOK,
+			Auth:           true,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id": 46,
+				},
+			},
+		},
+		Case{ // тот же ключ с другими параметрами
+			Path:           ApiUserCreate,
+			Method:         http.MethodPost,
+			Query:          "login=mr.otherone&age=32&full_name=Ivan_Ivanov",
+			IdempotencyKey: "retry-1",
+			Status:         http.StatusConflict,
+			Auth:           true,
+			Result: CR{
+				"error": "idempotency key is used with another payload",
+				"code":  "idempotency_mismatch",
 			},
 		},
 	}
@@ -262,6 +473,10 @@ func TestOtherApi(t *testing.T) {
 			Auth:   true,
 			Result: CR{
 				"error": "class must be one of [warrior, sorcerer, rouge]",
+				"code":  "enum",
+				"details": CR{
+					"param": "class",
+				},
 			},
 		},
 		Case{
@@ -307,6 +522,15 @@ func runTests(t *testing.T, ts *httptest.Server, cases []Case) {
 		if item.Auth {
 			req.Header.Add("X-Auth", "100500")
 		}
+		if item.Accept != "" {
+			req.Header.Add("Accept", item.Accept)
+		}
+		if item.IdempotencyKey != "" {
+			req.Header.Add("Idempotency-Key", item.IdempotencyKey)
+		}
+		for name, value := range item.Headers {
+			req.Header.Add(name, value)
+		}
 
 		resp, err := client.Do(req)
 		if err != nil {
@@ -315,6 +539,13 @@ func runTests(t *testing.T, ts *httptest.Server, cases []Case) {
 		}
 		defer resp.Body.Close()
 		body, err := ioutil.ReadAll(resp.Body)
+		if err == nil {
+			body, err = decodeBody(resp.Header.Get("Content-Encoding"), body)
+		}
+		if err != nil {
+			t.Errorf("[%s] cant read body: %v", caseName, err)
+			continue
+		}
 
 		// fmt.Printf("[%s] body: %s\n", caseName, string(body))
 
@@ -323,6 +554,34 @@ func runTests(t *testing.T, ts *httptest.Server, cases []Case) {
 			continue
 		}
 
+		contentType := "application/json; charset=utf-8"
+		if item.ContentType != "" {
+			contentType = item.ContentType
+		} else if item.Result == nil {
+			contentType = ""
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != contentType {
+			t.Errorf("[%s] expected content type %q, got %q", caseName, contentType, ct)
+			continue
+		}
+		if nosniff := resp.Header.Get("X-Content-Type-Options"); contentType != "" && nosniff != "nosniff" {
+			t.Errorf("[%s] expected X-Content-Type-Options: nosniff, got %q", caseName, nosniff)
+			continue
+		}
+
+		for name, value := range item.ResponseHeaders {
+			if got := strings.Join(resp.Header.Values(name), ", "); got != value {
+				t.Errorf("[%s] expected header %s: %q, got %q", caseName, name, value, got)
+			}
+		}
+
+		if item.Result == nil {
+			if string(body) != item.Body {
+				t.Errorf("[%s] bodies not match\nGot: %q\nExpected: %q", caseName, body, item.Body)
+			}
+			continue
+		}
+
 		err = json.Unmarshal(body, &result)
 		if err != nil {
 			t.Errorf("[%s] cant unpack json: %v", caseName, err)
@@ -342,3 +601,1091 @@ func runTests(t *testing.T, ts *httptest.Server, cases []Case) {
 		}
 	}
 }
+
+// msgpackCase - запрос /shape/echo в MessagePack с ожидаемыми байтами ответа
+func msgpackCase(query string, body string) Case {
+	return Case{
+		Path:        "/shape/echo",
+		Query:       query,
+		Accept:      "application/msgpack",
+		Status:      http.StatusOK,
+		ContentType: "application/msgpack",
+		Body:        body,
+	}
+}
+
+// manyShapes - ожидаемый ответ /shape/many
+func manyShapes(count int) []CR {
+	shapes := make([]CR, 0, count)
+	for i := 1; i <= count; i++ {
+		shapes = append(shapes, CR{"name": fmt.Sprintf("shape%d", i), "sides": i})
+	}
+	return shapes
+}
+
+// decodeBody распаковывает тело, сжатое сервером по Accept-Encoding из кейса
+func decodeBody(encoding string, body []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	switch encoding {
+	case "":
+		return body, nil
+	case "gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("unexpected content encoding %q", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+func TestCheckApi(t *testing.T) {
+	ts := httptest.NewServer(NewCheckApi())
+
+	cases := []Case{
+		Case{
+			// в режиме "all" проверки поля продолжаются после ошибки,
+			// а пустое обязательное значение больше не проверяется
+			Path:   "/check/all",
+			Query:  "login=AB",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "login len must be >= 3; login must match ^[a-z]+$; age must me not empty",
+				"code":  "invalid_params",
+				"fields": []CR{
+					CR{"param": "login", "code": "min", "message": "login len must be >= 3"},
+					CR{"param": "login", "code": "pattern", "message": "login must match ^[a-z]+$"},
+					CR{"param": "age", "code": "required", "message": "age must me not empty"},
+				},
+			},
+		},
+		Case{
+			Path:   "/check/all",
+			Query:  "login=ab&age=x",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "login len must be >= 3; age must be int",
+				"code":  "invalid_params",
+				"fields": []CR{
+					CR{"param": "login", "code": "min", "message": "login len must be >= 3"},
+					CR{"param": "age", "code": "type", "message": "age must be int"},
+				},
+			},
+		},
+		Case{
+			Path:   "/check/all",
+			Query:  "login=abc&age=18",
+			Status: http.StatusOK,
+			Result: CR{
+				"error":    "",
+				"response": CR{"login": "abc"},
+			},
+		},
+		Case{
+			// запятая внутри {1,3} не разделяет условия тега
+			Path:   "/check/pattern",
+			Query:  "code=ABC-12",
+			Status: http.StatusOK,
+			Result: CR{
+				"error":    "",
+				"response": CR{"login": "ABC-12"},
+			},
+		},
+		Case{
+			Path:   "/check/pattern",
+			Query:  "code=ABCD-1",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error":   "code must match ^[A-Z]{1,3}-[0-9]+$",
+				"code":    "pattern",
+				"details": CR{"param": "code"},
+			},
+		},
+		Case{
+			// условие после шаблона тоже проверяется
+			Path:   "/check/pattern",
+			Query:  "code=AB-1234567",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error":   "code len must be <= 8",
+				"code":    "max",
+				"details": CR{"param": "code"},
+			},
+		},
+		Case{
+			// пустые значения форматы не проверяют
+			Path:   "/check/format",
+			Status: http.StatusOK,
+			Result: CR{
+				"error":    "",
+				"response": CR{"login": ""},
+			},
+		},
+		Case{
+			Path: "/check/format",
+			Query: "email=user%40example.com&site=https%3A%2F%2Fexample.com%2Fa&id=123e4567-e89b-12d3-a456-426614174000" +
+				"&ipv4=10.0.0.1&ipv6=%3A%3A1&host=api.example.com&day=2024-02-29",
+			Status: http.StatusOK,
+			Result: CR{
+				"error":    "",
+				"response": CR{"login": "user@example.com"},
+			},
+		},
+		Case{
+			Path: "/check/format",
+			Query: "email=user&site=example.com&id=123e4567-e89b-12d3-a456-42661417400z" +
+				"&ipv4=%3A%3A1&ipv6=10.0.0.1&host=-bad-.example.com&day=2023-02-29",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "email must be a valid email; site must be a valid url; id must be a valid uuid; ipv4 must be a valid ipv4; " +
+					"ipv6 must be a valid ipv6; host must be a valid hostname; day must be a valid date",
+				"code": "invalid_params",
+				"fields": []CR{
+					CR{"param": "email", "code": "format", "message": "email must be a valid email"},
+					CR{"param": "site", "code": "format", "message": "site must be a valid url"},
+					CR{"param": "id", "code": "format", "message": "id must be a valid uuid"},
+					CR{"param": "ipv4", "code": "format", "message": "ipv4 must be a valid ipv4"},
+					CR{"param": "ipv6", "code": "format", "message": "ipv6 must be a valid ipv6"},
+					CR{"param": "host", "code": "format", "message": "host must be a valid hostname"},
+					CR{"param": "day", "code": "format", "message": "day must be a valid date"},
+				},
+			},
+		},
+		Case{
+			// Email обязателен, если Notify - true
+			Path:   "/check/notify",
+			Query:  "notify=true",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error":   "email is required if notify is set",
+				"code":    "requiredif",
+				"details": CR{"param": "email"},
+			},
+		},
+		Case{
+			Path:   "/check/notify",
+			Query:  "notify=yes",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error":   "notify must be bool",
+				"code":    "type",
+				"details": CR{"param": "notify"},
+			},
+		},
+		Case{
+			Path:   "/check/notify",
+			Query:  "notify=1&email=user%40example.com",
+			Status: http.StatusOK,
+			Result: CR{
+				"error":    "",
+				"response": CR{"login": "user@example.com"},
+			},
+		},
+		Case{
+			Path:   "/check/notify",
+			Query:  "notify=false",
+			Status: http.StatusOK,
+			Result: CR{
+				"error":    "",
+				"response": CR{"login": ""},
+			},
+		},
+		Case{
+			// ошибки Validate без статуса - 400
+			Path:   "/check/interval",
+			Query:  "from=5&to=3",
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "from must not exceed to", "code": "invalid"},
+		},
+		Case{
+			// ApiError из Validate сохраняет свой статус
+			Path:   "/check/interval",
+			Query:  "from=0&to=101",
+			Status: http.StatusUnprocessableEntity,
+			Result: CR{"error": "range is too wide", "code": "too_wide"},
+		},
+		Case{
+			Path:   "/check/match",
+			Query:  "result=win&page=2&limit=5",
+			Status: http.StatusOK,
+			Result: CR{
+				"error":    "",
+				"response": []CR{CR{"login": "win-2-cup-5"}},
+			},
+		},
+		Case{
+			Path:   "/check/match",
+			Query:  "result=draw&page=0",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "result must be one of [win, loss]; page must be >= 1",
+				"code":  "invalid_params",
+				"fields": []CR{
+					CR{"param": "result", "code": "enum", "message": "result must be one of [win, loss]"},
+					CR{"param": "page", "code": "min", "message": "page must be >= 1"},
+				},
+			},
+		},
+		Case{
+			Path:   "/check/ping",
+			Query:  "verbose=true",
+			Status: http.StatusOK,
+			Result: CR{
+				"error":    "",
+				"response": CR{"login": "pong"},
+			},
+		},
+		Case{
+			Path:   "/check/rules",
+			Query:  "from=1&to=2&min=4&max=4&password=secret&confirm=secret",
+			Status: http.StatusOK,
+			Result: CR{
+				"error":    "",
+				"response": CR{"login": "1-2"},
+			},
+		},
+		Case{
+			Path:   "/check/rules",
+			Query:  "from=2&to=2&min=5&max=4&password=secret&confirm=secrets",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "to must be greater than from; max must be greater than or equal to min; confirm must be equal to password",
+				"code":  "invalid_params",
+				"fields": []CR{
+					CR{"param": "to", "code": "gtfield", "message": "to must be greater than from"},
+					CR{"param": "max", "code": "gtefield", "message": "max must be greater than or equal to min"},
+					CR{"param": "confirm", "code": "eqfield", "message": "confirm must be equal to password"},
+				},
+			},
+		},
+		Case{
+			// правила с полем, которое уже не прошло проверку, не применяются
+			Path:   "/check/rules",
+			Query:  "from=abc&to=-1&min=x&max=-1",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "from must be int; min must be int",
+				"code":  "invalid_params",
+				"fields": []CR{
+					CR{"param": "from", "code": "type", "message": "from must be int"},
+					CR{"param": "min", "code": "type", "message": "min must be int"},
+				},
+			},
+		},
+		Case{
+			Path:   "/check/rules",
+			Query:  "to=-1",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "from must me not empty",
+				"code":  "invalid_params",
+				"fields": []CR{
+					CR{"param": "from", "code": "required", "message": "from must me not empty"},
+				},
+			},
+		},
+		Case{
+			Path:   "/check/interval",
+			Query:  "from=1&to=100",
+			Status: http.StatusOK,
+			Result: CR{
+				"error":    "",
+				"response": CR{"login": "1-100"},
+			},
+		},
+		Case{
+			// checkNotReserved объявлена в checks.go, а не в api.go
+			Path:   "/check/login",
+			Query:  "login=Root",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error":   "login Root is reserved",
+				"code":    "checkNotReserved",
+				"details": CR{"param": "login"},
+			},
+		},
+		Case{
+			Path:   "/check/login",
+			Query:  "login=rvasily",
+			Status: http.StatusOK,
+			Result: CR{
+				"error":    "",
+				"response": CR{"login": "rvasily"},
+			},
+		},
+		Case{
+			// повторяющиеся значения констант Level не дублируются в switch
+			Path:   "/check/level",
+			Query:  "level=2",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error":   "level must be one of [1, 3]",
+				"code":    "enum",
+				"details": CR{"param": "level"},
+			},
+		},
+		Case{
+			Path:   "/check/level",
+			Query:  "level=3",
+			Status: http.StatusOK,
+			Result: CR{
+				"error":    "",
+				"response": CR{"login": "3"},
+			},
+		},
+		Case{
+			Path:   "/check/level",
+			Status: http.StatusOK,
+			Result: CR{
+				"error":    "",
+				"response": CR{"login": "1"},
+			},
+		},
+	}
+
+	runTests(t, ts, cases)
+}
+
+func TestFailApi(t *testing.T) {
+	ts := httptest.NewServer(NewFailApi())
+
+	cases := []Case{
+		Case{
+			// обёрнутая ApiError сохраняет свой статус
+			Path:   "/fail",
+			Query:  "kind=wrapped",
+			Status: http.StatusGone,
+			Result: CR{"error": "user deleted", "code": "gone"},
+		},
+		Case{
+			Path:   "/fail",
+			Query:  "kind=pointer",
+			Status: http.StatusForbidden,
+			Result: CR{"error": "user hidden"},
+		},
+		Case{
+			// ошибку хранилища переводит в ApiError MapError получателя
+			Path:   "/fail",
+			Query:  "kind=mapped",
+			Status: http.StatusNotFound,
+			Result: CR{"error": "record not found", "code": "not_found"},
+		},
+		Case{
+			// у /fail нет timeout - чужой дедлайн обычная ошибка
+			Path:   "/fail",
+			Query:  "kind=deadline",
+			Status: http.StatusInternalServerError,
+			Result: CR{"error": "load user: context deadline exceeded", "code": "internal"},
+		},
+		Case{
+			Path:   "/fail",
+			Query:  "kind=plain",
+			Status: http.StatusInternalServerError,
+			Result: CR{"error": "database is down", "code": "internal"},
+		},
+	}
+	runTests(t, ts, cases)
+
+	// в production-режиме текст неизвестной ошибки скрыт
+	ApiProductionMode = true
+	defer func() { ApiProductionMode = false }()
+	runTests(t, ts, []Case{
+		Case{
+			Path:   "/fail",
+			Query:  "kind=plain",
+			Status: http.StatusInternalServerError,
+			Result: CR{"error": "internal error", "code": "internal"},
+		},
+		Case{
+			Path:   "/fail",
+			Query:  "kind=wrapped",
+			Status: http.StatusGone,
+			Result: CR{"error": "user deleted", "code": "gone"},
+		},
+	})
+}
+
+func TestTranslator(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+
+	ApiTranslator = CatalogTranslator{
+		"ru": {"required": "{param} не должен быть пустым"},
+	}
+	defer func() { ApiTranslator = nil }()
+
+	cases := []Case{
+		Case{
+			Path:    ApiUserProfile,
+			Headers: map[string]string{"Accept-Language": "ru-RU"},
+			Status:  http.StatusBadRequest,
+			Result: CR{
+				"error":   "login не должен быть пустым",
+				"code":    "required",
+				"details": CR{"param": "login"},
+			},
+		},
+		Case{
+			// языки выбираются по убыванию q
+			Path:    ApiUserProfile,
+			Headers: map[string]string{"Accept-Language": "de;q=0.9, ru;q=0.5"},
+			Status:  http.StatusBadRequest,
+			Result: CR{
+				"error":   "login не должен быть пустым",
+				"code":    "required",
+				"details": CR{"param": "login"},
+			},
+		},
+		Case{
+			// для языка без шаблонов остаётся английское сообщение
+			Path:    ApiUserProfile,
+			Headers: map[string]string{"Accept-Language": "de"},
+			Status:  http.StatusBadRequest,
+			Result: CR{
+				"error":   "login must me not empty",
+				"code":    "required",
+				"details": CR{"param": "login"},
+			},
+		},
+	}
+
+	runTests(t, ts, cases)
+}
+
+func TestShapeApi(t *testing.T) {
+	ts := httptest.NewServer(NewShapeApi())
+
+	cases := []Case{
+		Case{
+			Path:   "/shape/stats",
+			Status: http.StatusOK,
+			Result: []CR{
+				CR{"name": "triangle", "sides": 3, "calls": 0},
+				CR{"name": "square", "sides": 4, "calls": 0},
+			},
+		},
+		Case{
+			// элементы xml называются как поля json, корень - по типу результата
+			Path:        "/shape/bare",
+			Query:       "name=square",
+			Accept:      "application/xml",
+			Status:      http.StatusOK,
+			ContentType: "application/xml; charset=utf-8",
+			Body:        `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<Shape><name>square</name><sides>4</sides></Shape>`,
+		},
+		Case{
+			// поля встроенной структуры - отдельные колонки, как в json
+			Path:        "/shape/stats",
+			Accept:      "text/csv",
+			Status:      http.StatusOK,
+			ContentType: "text/csv; charset=utf-8",
+			Body:        "name,sides,calls\ntriangle,3,0\nsquare,4,0\n",
+		},
+		msgpackCase("name=ab&sides=3", "\x82\xa4name\xa2ab\xa5sides\x03"),
+		msgpackCase("name=ab&sides=-5", "\x82\xa4name\xa2ab\xa5sides\xd3\xff\xff\xff\xff\xff\xff\xff\xfb"),
+		msgpackCase("name=ab&sides=1099511627776", "\x82\xa4name\xa2ab\xa5sides\xd3\x00\x00\x01\x00\x00\x00\x00\x00"),
+		// длинные строки - str8 и str16
+		msgpackCase("name="+strings.Repeat("a", 40), "\x82\xa4name\xd9\x28"+strings.Repeat("a", 40)+"\xa5sides\x00"),
+		msgpackCase("name="+strings.Repeat("b", 300), "\x82\xa4name\xda\x01\x2c"+strings.Repeat("b", 300)+"\xa5sides\x00"),
+		Case{
+			// у списка без конверта нет корневого элемента xml
+			Path:        "/shape/stats",
+			Accept:      "application/xml",
+			Status:      http.StatusNotAcceptable,
+			ContentType: "application/problem+json",
+			Result: CR{
+				"type":     "about:blank",
+				"title":    "Not Acceptable",
+				"status":   406,
+				"detail":   "not acceptable",
+				"instance": "/shape/stats",
+				"code":     "not_acceptable",
+			},
+		},
+		Case{
+			// без конверта отдаётся сам результат
+			Path:   "/shape/bare",
+			Query:  "name=square",
+			Status: http.StatusOK,
+			Result: CR{"name": "square", "sides": 4},
+		},
+		Case{
+			// а ошибки - в формате problem+json
+			Path:        "/shape/bare",
+			Query:       "name=circle",
+			Status:      http.StatusNotFound,
+			ContentType: "application/problem+json",
+			Result: CR{
+				"type":     "about:blank",
+				"title":    "Not Found",
+				"status":   404,
+				"detail":   "shape not found",
+				"instance": "/shape/bare",
+				"code":     "not_found",
+			},
+		},
+		Case{
+			Path:   "/shape/custom",
+			Query:  "name=triangle",
+			Status: http.StatusOK,
+			Result: CR{
+				"ok":   true,
+				"data": CR{"name": "triangle", "sides": 3},
+			},
+		},
+		Case{
+			Path:   "/shape/custom",
+			Query:  "name=circle",
+			Status: http.StatusNotFound,
+			Result: CR{"ok": false, "error": "shape not found"},
+		},
+		Case{
+			Path:   "/shape/custom",
+			Status: http.StatusBadRequest,
+			Result: CR{"ok": false, "error": "name must me not empty"},
+		},
+		Case{
+			// без режима "all" в invalid-params - параметр первой ошибки
+			Path:        "/shape/bare",
+			Status:      http.StatusBadRequest,
+			ContentType: "application/problem+json",
+			Result: CR{
+				"type":     "about:blank",
+				"title":    "Bad Request",
+				"status":   400,
+				"detail":   "name must me not empty",
+				"instance": "/shape/bare",
+				"code":     "required",
+				"invalid-params": []CR{
+					CR{"name": "name", "code": "required", "reason": "name must me not empty"},
+				},
+			},
+		},
+		Case{
+			// все ошибки параметров перечисляются в invalid-params
+			Path:        "/shape/problem",
+			Query:       "sides=1",
+			Status:      http.StatusBadRequest,
+			ContentType: "application/problem+json",
+			Result: CR{
+				"type":     "about:blank",
+				"title":    "Bad Request",
+				"status":   400,
+				"detail":   "name must me not empty; sides must be >= 3",
+				"instance": "/shape/problem",
+				"code":     "invalid_params",
+				"invalid-params": []CR{
+					CR{"name": "name", "code": "required", "reason": "name must me not empty"},
+					CR{"name": "sides", "code": "min", "reason": "sides must be >= 3"},
+				},
+			},
+		},
+		Case{
+			Path:   "/shape/problem",
+			Query:  "name=hexagon&sides=6",
+			Status: http.StatusOK,
+			Result: CR{
+				"error":    "",
+				"response": CR{"name": "hexagon", "sides": 6},
+			},
+		},
+		Case{
+			// результат-значение, а не указатель
+			Path:   "/shape/value",
+			Query:  "name=square",
+			Status: http.StatusOK,
+			Result: CR{
+				"error":    "",
+				"response": CR{"name": "square", "sides": 4},
+			},
+		},
+		Case{
+			Path:   "/shape/list",
+			Status: http.StatusOK,
+			Result: CR{
+				"error": "",
+				"response": []CR{
+					CR{"name": "triangle", "sides": 3},
+					CR{"name": "square", "sides": 4},
+				},
+			},
+		},
+		Case{
+			Path:            "/shape/bare",
+			Query:           "name=square",
+			Status:          http.StatusOK,
+			ResponseHeaders: map[string]string{"ETag": `"square-4"`},
+			Result:          CR{"name": "square", "sides": 4},
+		},
+		Case{
+			// версия не изменилась - тело не отдаётся
+			Path:            "/shape/bare",
+			Query:           "name=square",
+			Headers:         map[string]string{"If-None-Match": `"circle-0", "square-4"`},
+			Status:          http.StatusNotModified,
+			ResponseHeaders: map[string]string{"ETag": `"square-4"`},
+		},
+		Case{
+			Path:    "/shape/bare",
+			Query:   "name=square",
+			Headers: map[string]string{"If-None-Match": `"square-5"`},
+			Status:  http.StatusOK,
+			Result:  CR{"name": "square", "sides": 4},
+		},
+		Case{
+			// If-Match с чужой версией - фигура не удаляется
+			Path:    "/shape/remove",
+			Method:  http.MethodPost,
+			Query:   "name=triangle",
+			Headers: map[string]string{"If-Match": `"triangle-4"`},
+			Status:  http.StatusPreconditionFailed,
+			Result:  CR{"error": "precondition failed", "code": "precondition_failed"},
+		},
+		Case{
+			Path:    "/shape/remove",
+			Method:  http.MethodPost,
+			Query:   "name=circle",
+			Headers: map[string]string{"If-Match": "*"},
+			Status:  http.StatusPreconditionFailed,
+			Result:  CR{"error": "precondition failed", "code": "precondition_failed"},
+		},
+		Case{
+			// метод, возвращающий только error, отвечает 204 без тела
+			Headers: map[string]string{"If-Match": `"triangle-3"`},
+			Path:    "/shape/remove",
+			Method:  http.MethodPost,
+			Query:   "name=triangle",
+			Status:  http.StatusNoContent,
+		},
+		Case{
+			Path:   "/shape/remove",
+			Method: http.MethodPost,
+			Query:  "name=triangle",
+			Status: http.StatusNotFound,
+			Result: CR{"error": "shape not found", "code": "not_found"},
+		},
+		Case{
+			// triangle удалён
+			Path:   "/shape/list",
+			Status: http.StatusOK,
+			Result: CR{
+				"error":    "",
+				"response": []CR{CR{"name": "square", "sides": 4}},
+			},
+		},
+		Case{
+			Path:            "/shape/pages",
+			Query:           "limit=3",
+			Status:          http.StatusOK,
+			ResponseHeaders: map[string]string{"Link": `</shape/pages?limit=3&offset=3>; rel="next"`},
+			Result: CR{
+				"error": "",
+				"response": []CR{
+					CR{"name": "shape1", "sides": 1},
+					CR{"name": "shape2", "sides": 2},
+					CR{"name": "shape3", "sides": 3},
+				},
+			},
+		},
+		Case{
+			// неполная страница - последняя
+			Path:            "/shape/pages",
+			Query:           "limit=3&offset=6",
+			Status:          http.StatusOK,
+			ResponseHeaders: map[string]string{"Link": ""},
+			Result: CR{
+				"error": "",
+				"response": []CR{
+					CR{"name": "shape7", "sides": 7},
+					CR{"name": "shape8", "sides": 8},
+				},
+			},
+		},
+		Case{
+			Path:   "/shape/pages",
+			Query:  "limit=0",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error":   "limit must be >= 1",
+				"code":    "min",
+				"details": CR{"param": "limit"},
+			},
+		},
+		Case{
+			Path:            "/shape/cursor",
+			Query:           "limit=3&cursor=4",
+			Status:          http.StatusOK,
+			ResponseHeaders: map[string]string{"Link": `</shape/cursor?cursor=7&limit=3>; rel="next"`},
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"items": []CR{
+						CR{"name": "shape4", "sides": 4},
+						CR{"name": "shape5", "sides": 5},
+						CR{"name": "shape6", "sides": 6},
+					},
+				},
+				"next_cursor": "7",
+			},
+		},
+		Case{
+			Path:            "/shape/cursor",
+			Query:           "limit=3&cursor=7",
+			Status:          http.StatusOK,
+			ResponseHeaders: map[string]string{"Link": ""},
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"items": []CR{
+						CR{"name": "shape7", "sides": 7},
+						CR{"name": "shape8", "sides": 8},
+					},
+				},
+			},
+		},
+		Case{
+			// большой ответ сжимается первой поддерживаемой кодировкой
+			Path:            "/shape/many",
+			Query:           "count=100",
+			Headers:         map[string]string{"Accept-Encoding": "br, gzip;q=0.5, deflate;q=0.8"},
+			Status:          http.StatusOK,
+			ResponseHeaders: map[string]string{"Content-Encoding": "deflate", "Vary": "Accept, Accept-Encoding"},
+			Result:          CR{"error": "", "response": manyShapes(100)},
+		},
+		Case{
+			Path:            "/shape/many",
+			Query:           "count=100",
+			Headers:         map[string]string{"Accept-Encoding": "gzip"},
+			Status:          http.StatusOK,
+			ResponseHeaders: map[string]string{"Content-Encoding": "gzip"},
+			Result:          CR{"error": "", "response": manyShapes(100)},
+		},
+		Case{
+			// маленький ответ не сжимается
+			Path:            "/shape/many",
+			Query:           "count=2",
+			Headers:         map[string]string{"Accept-Encoding": "gzip"},
+			Status:          http.StatusOK,
+			ResponseHeaders: map[string]string{"Content-Encoding": ""},
+			Result:          CR{"error": "", "response": manyShapes(2)},
+		},
+		Case{
+			Path:            "/shape/many",
+			Query:           "count=100",
+			Headers:         map[string]string{"Accept-Encoding": "identity"},
+			Status:          http.StatusOK,
+			ResponseHeaders: map[string]string{"Content-Encoding": ""},
+			Result:          CR{"error": "", "response": manyShapes(100)},
+		},
+	}
+
+	runTests(t, ts, cases)
+
+	// с ProblemTypeBase type строится из кода ошибки
+	ProblemTypeBase = "https://example.com/problems/"
+	defer func() { ProblemTypeBase = "" }()
+	runTests(t, ts, []Case{
+		Case{
+			Path:        "/shape/problem",
+			Query:       "name=hexagon&sides=13",
+			Status:      http.StatusBadRequest,
+			ContentType: "application/problem+json",
+			Result: CR{
+				"type":     "https://example.com/problems/invalid_params",
+				"title":    "Bad Request",
+				"status":   400,
+				"detail":   "sides must be <= 12",
+				"instance": "/shape/problem",
+				"code":     "invalid_params",
+				"invalid-params": []CR{
+					CR{"name": "sides", "code": "max", "reason": "sides must be <= 12"},
+				},
+			},
+		},
+	})
+}
+
+// statCase - запрос /shape/stat, на который отвечает вызов Stat номер calls
+func statCase(name string, sides int, calls int) Case {
+	return Case{
+		Path:            "/shape/stat",
+		Query:           "name=" + name,
+		Status:          http.StatusOK,
+		ResponseHeaders: map[string]string{"Cache-Control": "max-age=1"},
+		Result: CR{
+			"error":    "",
+			"response": CR{"name": name, "sides": sides, "calls": calls},
+		},
+	}
+}
+
+func TestShapeApiCache(t *testing.T) {
+	PurgeApiCache()
+	// часы кэша двигаются тестом, а не ожиданием
+	now := time.Now()
+	apiCache.now = func() time.Time { return now }
+	defer func() { apiCache.now = time.Now }()
+	srv := NewShapeApi()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	runTests(t, ts, []Case{
+		statCase("triangle", 3, 1),
+		// повторный запрос отдаётся из кэша
+		statCase("triangle", 3, 1),
+		statCase("square", 4, 2),
+		statCase("square", 4, 2),
+		Case{
+			// ошибки не кэшируются
+			Path:            "/shape/stat",
+			Query:           "name=circle",
+			Status:          http.StatusNotFound,
+			ResponseHeaders: map[string]string{"Cache-Control": ""},
+			Result:          CR{"error": "shape not found", "code": "not_found"},
+		},
+		Case{
+			// результат из кэша, но без подходящего формата - 406 без Cache-Control
+			Path:            "/shape/stat",
+			Query:           "name=square",
+			Accept:          "text/csv",
+			Status:          http.StatusNotAcceptable,
+			ResponseHeaders: map[string]string{"Cache-Control": ""},
+			Result:          CR{"error": "not acceptable", "code": "not_acceptable"},
+		},
+	})
+
+	// хук сбрасывает результаты только для своих параметров
+	srv.InvalidateStatCache("square")
+	runTests(t, ts, []Case{
+		statCase("square", 4, 3),
+		statCase("triangle", 3, 1),
+	})
+
+	// после TTL результаты запрашиваются заново
+	now = now.Add(1100 * time.Millisecond)
+	runTests(t, ts, []Case{
+		statCase("triangle", 3, 4),
+		statCase("triangle", 3, 4),
+	})
+
+	// в кэше остаются только последние ApiCacheSize результатов
+	defer func(size int) { ApiCacheSize = size }(ApiCacheSize)
+	ApiCacheSize = 1
+	runTests(t, ts, []Case{
+		statCase("square", 4, 5),
+		statCase("triangle", 3, 6),
+		statCase("triangle", 3, 6),
+		statCase("square", 4, 7),
+	})
+}
+
+// addCase - повтор /shape/add с ключом "add-1"
+func addCase(headers map[string]string, responseHeaders map[string]string) Case {
+	return Case{
+		Path:            "/shape/add",
+		Method:          http.MethodPost,
+		Query:           "name=pentagon&sides=5",
+		IdempotencyKey:  "add-1",
+		Headers:         headers,
+		Status:          http.StatusOK,
+		ResponseHeaders: responseHeaders,
+		Result: CR{
+			"error":    "",
+			"response": CR{"name": "pentagon", "sides": 5},
+		},
+	}
+}
+
+func TestShapeApiIdempotency(t *testing.T) {
+	defer func(size int) { CompressMinSize = size }(CompressMinSize)
+	CompressMinSize = 1
+	ts := httptest.NewServer(NewShapeApi())
+	defer ts.Close()
+
+	gzipped := map[string]string{"Accept-Encoding": "gzip"}
+	plain := map[string]string{"Accept-Encoding": "identity"}
+	runTests(t, ts, []Case{
+		addCase(gzipped, map[string]string{"Content-Encoding": "gzip", "Idempotent-Replayed": ""}),
+		// сохранённый ответ сжимается заново по Accept-Encoding повтора
+		addCase(plain, map[string]string{"Content-Encoding": "", "Idempotent-Replayed": "true"}),
+		addCase(gzipped, map[string]string{"Content-Encoding": "gzip", "Idempotent-Replayed": "true"}),
+		Case{
+			// ключи других пользователей не пересекаются - запрос выполняется снова
+			Path:           "/shape/add",
+			Method:         http.MethodPost,
+			Query:          "name=pentagon&sides=5",
+			IdempotencyKey: "add-1",
+			Headers:        map[string]string{"X-Auth": "100501"},
+			Status:         http.StatusConflict,
+			Result:         CR{"error": "shape exists", "code": "exists"},
+		},
+	})
+
+	// как и ключи другого экземпляра API
+	other := httptest.NewServer(NewShapeApi())
+	defer other.Close()
+	runTests(t, other, []Case{
+		addCase(plain, map[string]string{"Idempotent-Replayed": ""}),
+	})
+}
+
+func TestShapeApiLimits(t *testing.T) {
+	ts := httptest.NewServer(NewShapeApi())
+	defer ts.Close()
+
+	runTests(t, ts, []Case{
+		Case{
+			Path:   "/shape/draw",
+			Method: http.MethodPost,
+			Query:  "name=square",
+			Status: http.StatusOK,
+			Result: CR{"error": "", "response": CR{"name": "square", "sides": 4}},
+		},
+		Case{
+			// тело больше max_body
+			Path:   "/shape/draw",
+			Method: http.MethodPost,
+			Query:  "name=" + strings.Repeat("square", 20),
+			Status: http.StatusRequestEntityTooLarge,
+			Result: CR{"error": "request body is too large", "code": "body_too_large"},
+		},
+		Case{
+			Path:   "/shape/draw",
+			Method: http.MethodPost,
+			Query:  "name=%zz",
+			Status: http.StatusBadRequest,
+			Result: CR{"error": `invalid URL escape "%zz"`, "code": "bad_request"},
+		},
+		Case{
+			// дедлайн запроса метода истёк раньше timeout обработчика
+			Path:   "/shape/draw",
+			Method: http.MethodPost,
+			Query:  "name=square&query=true",
+			Status: http.StatusInternalServerError,
+			Result: CR{"error": "query: context deadline exceeded", "code": "internal"},
+		},
+		Case{
+			// метод не уложился в timeout
+			Path:   "/shape/draw",
+			Method: http.MethodPost,
+			Query:  "name=square&wait=true",
+			Status: http.StatusGatewayTimeout,
+			Result: CR{"error": "timeout", "code": "timeout"},
+		},
+	})
+}
+
+func TestFeedApi(t *testing.T) {
+	ts := httptest.NewServer(NewFeedApi())
+
+	cases := []Case{
+		Case{
+			Path:        "/feed/channel",
+			Query:       "count=2",
+			Status:      http.StatusOK,
+			ContentType: "application/x-ndjson",
+			Body:        `{"name":"shape1","sides":1}` + "\n" + `{"name":"shape2","sides":2}` + "\n",
+		},
+		Case{
+			// поток ndjson - не документ json
+			Path:   "/feed/iterator",
+			Query:  "count=2",
+			Accept: "application/json",
+			Status: http.StatusNotAcceptable,
+			Result: CR{
+				"error": "not acceptable",
+				"code":  "not_acceptable",
+			},
+		},
+		Case{
+			Path:        "/feed/iterator",
+			Query:       "count=2",
+			Accept:      "application/json, application/x-ndjson;q=0.5",
+			Status:      http.StatusOK,
+			ContentType: "application/x-ndjson",
+			Body:        `{"name":"shape1","sides":1}` + "\n" + `{"name":"shape2","sides":2}` + "\n",
+		},
+		Case{
+			Path:   "/feed/iterator",
+			Accept: "text/csv",
+			Status: http.StatusNotAcceptable,
+			Result: CR{
+				"error": "not acceptable",
+				"code":  "not_acceptable",
+			},
+		},
+		Case{
+			// ошибка после начала потока - последняя строка
+			Path:        "/feed/broken",
+			Query:       "count=1",
+			Status:      http.StatusOK,
+			ContentType: "application/x-ndjson",
+			Body:        `{"name":"shape1","sides":1}` + "\n" + `{"error":"feed is broken","code":"internal"}` + "\n",
+		},
+		Case{
+			Path:            "/feed/events",
+			Query:           "count=2",
+			Status:          http.StatusOK,
+			ContentType:     "text/event-stream",
+			ResponseHeaders: map[string]string{"Cache-Control": "no-cache"},
+			Body: "id: 1\nevent: shape\ndata: {\"name\":\"shape1\",\"sides\":1}\n\n" +
+				"id: 2\nevent: shape\ndata: {\"name\":\"shape2\",\"sides\":2}\n\n",
+		},
+		Case{
+			// переподключившийся клиент получает события после Last-Event-ID
+			Path:        "/feed/events",
+			Query:       "count=1",
+			Headers:     map[string]string{"Last-Event-ID": "7"},
+			Status:      http.StatusOK,
+			ContentType: "text/event-stream",
+			Body:        "id: 8\nevent: shape\ndata: {\"name\":\"shape8\",\"sides\":8}\n\n",
+		},
+		Case{
+			// ошибка после начала потока - событие error
+			Path:        "/feed/events",
+			Query:       "count=1&fail=true",
+			Status:      http.StatusOK,
+			ContentType: "text/event-stream",
+			Body: "id: 1\nevent: shape\ndata: {\"name\":\"shape1\",\"sides\":1}\n\n" +
+				"event: error\ndata: {\"error\":\"feed is broken\",\"code\":\"internal\"}\n\n",
+		},
+		Case{
+			Path:   "/feed/events",
+			Accept: "application/json",
+			Status: http.StatusNotAcceptable,
+			Result: CR{
+				"error": "not acceptable",
+				"code":  "not_acceptable",
+			},
+		},
+	}
+
+	runTests(t, ts, cases)
+}
+
+func TestFeedApiDisconnect(t *testing.T) {
+	srv := NewFeedApi()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	resp, err := client.Get(ts.URL + "/feed/endless")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != `{"name":"shape1","sides":1}`+"\n" {
+		t.Fatalf("unexpected first line %q: %v", line, err)
+	}
+	// клиент уходит, не дочитав поток
+	resp.Body.Close()
+
+	select {
+	case <-srv.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stream wasn't stopped after the client had gone")
+	}
+}